@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+// defaultAPI returns the API address written by a running daemon to
+// $IPFS_PATH/api, or the default address if there is no such file.
+func defaultAPI() string {
+	dir := os.Getenv("IPFS_PATH")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".ipfs")
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "api"))
+	if err != nil {
+		return "/ip4/127.0.0.1/tcp/5001"
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// APIOptions controls how requests to the RPC API are authenticated.
+type APIOptions struct {
+	// Auth is sent with every request, in the same format as the daemon's
+	// API.Authorizations config: "basic:user:password" or "bearer:token".
+	Auth string
+
+	// CAFile is a PEM file of certificate authorities to trust in addition
+	// to the system roots. CertFile and KeyFile are a client certificate.
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+func (opts APIOptions) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if opts.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func (opts APIOptions) authorization() (string, error) {
+	if opts.Auth == "" {
+		return "", nil
+	}
+
+	i := strings.IndexByte(opts.Auth, ':')
+	if i == -1 {
+		return "", fmt.Errorf("invalid API authorization: expected basic:user:password or bearer:token")
+	}
+	switch scheme, secret := opts.Auth[:i], opts.Auth[i+1:]; scheme {
+	case "basic":
+		if !strings.Contains(secret, ":") {
+			return "", fmt.Errorf("invalid API authorization: expected basic:user:password")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(secret)), nil
+	case "bearer":
+		return "Bearer " + secret, nil
+	default:
+		return "", fmt.Errorf("invalid API authorization: unknown scheme %q", scheme)
+	}
+}
+
+// authTransport adds an Authorization header to every request.
+type authTransport struct {
+	http.RoundTripper
+	Authorization string
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request they are given.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", t.Authorization)
+	return t.RoundTripper.RoundTrip(r)
+}
+
+// newShell connects to the daemon's RPC API at api, which is either a
+// multiaddr such as /ip4/127.0.0.1/tcp/5001 or /unix/run/ipfs.sock, or an
+// http or https URL.
+func newShell(api string, opts APIOptions) (*shell.Shell, error) {
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	auth, err := opts.authorization()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		DisableKeepAlives: true,
+		TLSClientConfig:   tlsConfig,
+	}
+
+	url := api
+	if strings.HasPrefix(api, "/") {
+		network, addr, scheme, err := parseMultiaddr(api)
+		if err != nil {
+			return nil, err
+		}
+
+		if network == "unix" {
+			socket := addr
+			transport.Proxy = nil
+			transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			}
+			addr = "unix"
+		}
+		url = scheme + "://" + addr
+	} else if !strings.HasPrefix(api, "http://") && !strings.HasPrefix(api, "https://") {
+		return nil, fmt.Errorf("invalid API address %q: must be a multiaddr or an http or https URL", api)
+	}
+
+	client := &http.Client{Transport: transport}
+	if auth != "" {
+		client.Transport = &authTransport{RoundTripper: transport, Authorization: auth}
+	}
+
+	return shell.NewShellWithClient(strings.TrimSuffix(url, "/"), client), nil
+}
+
+// parseMultiaddr converts a multiaddr to a network and address that can be
+// passed to net.Dial, along with the URL scheme to use.
+func parseMultiaddr(addr string) (network, address, scheme string, err error) {
+	parts := strings.Split(strings.TrimPrefix(addr, "/"), "/")
+	invalid := func() (string, string, string, error) {
+		return "", "", "", fmt.Errorf("invalid API address %q: unsupported multiaddr", addr)
+	}
+
+	if len(parts) >= 2 && parts[0] == "unix" {
+		return "unix", "/" + strings.Join(parts[1:], "/"), "http", nil
+	}
+
+	if len(parts) < 4 || parts[2] != "tcp" {
+		return invalid()
+	}
+	var host string
+	switch parts[0] {
+	case "ip4", "dns", "dns4", "dns6", "dnsaddr":
+		host = parts[1]
+	case "ip6":
+		host = "[" + parts[1] + "]"
+	default:
+		return invalid()
+	}
+
+	scheme = "http"
+	switch {
+	case len(parts) == 4:
+	case len(parts) == 5 && (parts[4] == "http" || parts[4] == "https"):
+		scheme = parts[4]
+	default:
+		return invalid()
+	}
+
+	return "tcp", host + ":" + parts[3], scheme, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	pathutil "path"
+	"time"
+)
+
+// Backend is the set of operations the filesystem needs from an IPFS node.
+//
+// Methods that look something up return a nil result and a nil error if the
+// path does not exist. Errors reported by the daemon are returned as
+// *shell.Error so that they can be classified by errno.
+type Backend interface {
+	Stat(ctx context.Context, path string) (*UnixFSStat, error)
+	List(ctx context.Context, path string, long bool) (*UnixFSList, error)
+	ListImmutable(ctx context.Context, path string) (*UnixFSList, error)
+	Resolve(ctx context.Context, name string) (string, error)
+
+	// Cat and Read return the content of a file in /ipfs or MFS
+	// respectively. A length of -1 reads to the end of the file.
+	Cat(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error)
+	Read(ctx context.Context, path string, offset, count int64) (io.ReadCloser, error)
+
+	// Write streams r into a file in MFS. r may still be read from after
+	// the daemon has replied, but not after Write returns.
+	Write(ctx context.Context, path string, r io.Reader, opts WriteOptions) error
+	Mkdir(ctx context.Context, path string, opts DAGOptions) error
+
+	// PutBlocks adds blocks with the given codec ("raw" or "dag-pb") to the
+	// daemon's blockstore and GetBlock returns one. PutBlock adds a single
+	// block hashed with the given function and returns its CIDv1. Copy
+	// copies an MFS or /ipfs path into MFS.
+	PutBlocks(ctx context.Context, codec string, blocks [][]byte) error
+	PutBlock(ctx context.Context, codec, hash string, block []byte) (string, error)
+	GetBlock(ctx context.Context, cid string) ([]byte, error)
+	Copy(ctx context.Context, src, dst string) error
+
+	// Chmod and Touch set the UnixFS 1.5 mode and mtime of an MFS path.
+	Chmod(ctx context.Context, path string, mode uint32) error
+	Touch(ctx context.Context, path string, mtime time.Time) error
+
+	Remove(ctx context.Context, path string, recursive bool) error
+	Move(ctx context.Context, oldPath, newPath string) error
+	Flush(ctx context.Context, path string) error
+}
+
+type WriteOptions struct {
+	Offset   int64
+	Create   bool
+	Truncate bool
+	DAG      DAGOptions
+}
+
+// NodeType uses the same values as the Type field in files/ls output.
+// files/ls reports symlinks as files; Symlink is the UnixFS type.
+type NodeType int
+
+const (
+	File      NodeType = 0
+	Directory NodeType = 1
+	Symlink   NodeType = 4
+)
+
+type UnixFSList struct {
+	Entries []UnixFSDirEntry
+}
+
+type UnixFSDirEntry struct {
+	Name string
+	Type NodeType
+	Size uint64
+	Hash string
+
+	// stat is set by FastList if it has the full attributes of the entry.
+	stat *UnixFSStat
+}
+
+type UnixFSStat struct {
+	Hash           string
+	Size           uint64
+	CumulativeSize uint64
+	Blocks         int
+	Type           string
+	WithLocality   bool
+	Local          bool
+	SizeLocal      uint64
+
+	// UnixFS 1.5 metadata, or zero if the node has none.
+	Mode       os.FileMode
+	Mtime      int64
+	MtimeNsecs int64
+}
+
+func FastStat(ctx context.Context, b Backend, path string) (*UnixFSStat, error) {
+	// Stat-ing a directory is very slow.
+
+	// First thing to try: List it as if it were a directory.
+	list, err := b.List(ctx, path+"/", false)
+	if err != nil || list == nil {
+		return nil, err
+	}
+
+	// The only entry is an unnamed file.
+	if len(list.Entries) == 1 && list.Entries[0].Name == "" {
+		// It is safe to call Stat on files for the most part.
+		return b.Stat(ctx, path)
+	}
+
+	return &UnixFSStat{
+		Type: "directory",
+		Hash: "", // hash not available through this method
+		Size: uint64(len(list.Entries)),
+	}, nil
+}
+
+func FastList(ctx context.Context, b Backend, path string) (*UnixFSList, error) {
+	list, err := b.List(ctx, path+"/", false)
+	if err != nil || list == nil || len(list.Entries) == 0 ||
+		(len(list.Entries) == 1 && list.Entries[0].Name == "") {
+		return list, err
+	}
+
+	if len(list.Entries) > 100 {
+		// Bite the bullet and just go for the slow route.
+		return b.List(ctx, path+"/", true)
+	}
+
+	for i := range list.Entries {
+		entry := &list.Entries[i]
+		stat, err := FastStat(ctx, b, pathutil.Join(path, entry.Name))
+		if err != nil || stat == nil {
+			return nil, err
+		}
+
+		switch stat.Type {
+		case "directory":
+			entry.Type = Directory
+		case "symlink":
+			entry.Type = Symlink
+		default:
+			entry.Type = File
+		}
+
+		entry.Hash = stat.Hash
+		entry.Size = stat.Size
+		if stat.Hash != "" {
+			entry.stat = stat
+		}
+	}
+
+	return list, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var flagCacheDir = flag.String("cache-dir", "", "directory to cache file contents read from /ipfs in (default: no cache)")
+var flagCacheSize = flag.Int64("cache-size", 1<<30, "maximum size in bytes of the chunks in -cache-dir")
+
+// cacheChunkSize is the size of the ranges of a file that are stored in the
+// block cache. Reads from the daemon are rounded out to whole chunks.
+const cacheChunkSize = 1 << 20
+
+// blockCache is nil if there is no cache directory.
+var blockCache *BlockCache
+
+// BlockCache stores chunks of immutable files on disk, keyed by CID and chunk
+// number, in a directory of its own. The least recently used chunks are removed when the total size
+// goes over Limit. Access times are kept in the modification time of each
+// file so that the order survives a restart.
+type BlockCache struct {
+	Dir   string
+	Limit int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// OpenBlockCache opens or creates the block cache in dir. The chunks are
+// kept in a subdirectory, so that a dir that is used for anything else
+// does not lose its files to eviction.
+func OpenBlockCache(dir string, limit int64) (*BlockCache, error) {
+	dir = filepath.Join(dir, "blocks")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+
+	c := &BlockCache{
+		Dir:     dir,
+		Limit:   limit,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	for _, fi := range infos {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(fi.Name(), ".tmp") {
+			// left over from a crash while writing
+			os.Remove(filepath.Join(dir, fi.Name()))
+			continue
+		}
+		if !isCacheKey(fi.Name()) {
+			continue
+		}
+		c.entries[fi.Name()] = c.lru.PushBack(&cacheEntry{key: fi.Name(), size: fi.Size()})
+		c.size += fi.Size()
+	}
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+
+	return c, nil
+}
+
+func cacheKey(hash string, chunk int64) string {
+	return hash + "." + strconv.FormatInt(chunk, 10)
+}
+
+// isCacheKey reports whether name is in the format of cacheKey.
+func isCacheKey(name string) bool {
+	i := strings.LastIndexByte(name, '.')
+	if i <= 0 {
+		return false
+	}
+	for _, r := range name[:i] {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z') {
+			return false
+		}
+	}
+	chunk, err := strconv.ParseInt(name[i+1:], 10, 64)
+	return err == nil && chunk >= 0
+}
+
+// Get returns the cached data for a chunk, if there is any.
+func (c *BlockCache) Get(hash string, chunk int64) ([]byte, bool) {
+	key := cacheKey(hash, chunk)
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	name := filepath.Join(c.Dir, key)
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		// evicted since we checked, or removed by someone else
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(name, now, now)
+
+	return data, true
+}
+
+// Put stores the data for a chunk. Errors are logged, as the cache is only
+// an optimization.
+func (c *BlockCache) Put(hash string, chunk int64, data []byte) {
+	key := cacheKey(hash, chunk)
+	size := int64(len(data))
+	if size > c.Limit {
+		return
+	}
+
+	c.mu.Lock()
+	_, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok {
+		return
+	}
+
+	// Write to a temporary file first so that a crash never leaves a
+	// partial chunk under its real name.
+	f, err := ioutil.TempFile(c.Dir, ".tmp")
+	if err != nil {
+		log.Println("block cache:", err)
+		return
+	}
+	_, err = f.Write(data)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(c.Dir, key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		log.Println("block cache:", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		// another read stored the same chunk while we were writing it
+		c.size -= e.Value.(*cacheEntry).size
+		c.lru.Remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: size})
+	c.size += size
+	c.evict()
+}
+
+// evict removes the least recently used chunks until the cache fits within
+// its limit. c.mu must be held.
+func (c *BlockCache) evict() {
+	for c.size > c.Limit {
+		e := c.lru.Back()
+		entry := c.lru.Remove(e).(*cacheEntry)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+		if err := os.Remove(filepath.Join(c.Dir, entry.key)); err != nil && !os.IsNotExist(err) {
+			log.Println("block cache:", err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlockCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-fuse-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := OpenBlockCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Put("a", 0, []byte("aaaa"))
+	c.Put("b", 0, []byte("bbbb"))
+	if data, ok := c.Get("a", 0); !ok || string(data) != "aaaa" {
+		t.Errorf("get a: %q, %v", data, ok)
+	}
+	c.Put("c", 0, []byte("cccc"))
+
+	if _, ok := c.Get("b", 0); ok {
+		t.Error("least recently used chunk was not evicted")
+	}
+	if _, ok := c.Get("b", 1); ok {
+		t.Error("got a chunk that was never stored")
+	}
+
+	// A leftover temporary file should be cleaned up when reopening, and
+	// files that are not chunks should be left alone.
+	if err := ioutil.WriteFile(filepath.Join(c.Dir, ".tmp123"), []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	others := []string{filepath.Join(dir, "a.0"), filepath.Join(dir, "notes.txt"), filepath.Join(c.Dir, "notes.txt")}
+	for _, name := range others {
+		if err := ioutil.WriteFile(name, []byte("not a chunk"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err = OpenBlockCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "c"} {
+		if data, ok := c.Get(key, 0); !ok || string(data) != key+key+key+key {
+			t.Errorf("get %s after reopening: %q, %v", key, data, ok)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(c.Dir, ".tmp123")); !os.IsNotExist(err) {
+		t.Errorf("temporary file was not removed: %v", err)
+	}
+
+	// Shrinking the limit evicts on open.
+	c, err = OpenBlockCache(dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.size > 4 {
+		t.Errorf("cache size %d over limit after reopening", c.size)
+	}
+	for _, name := range others {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("evicting removed %s: %v", name, err)
+		}
+	}
+}
+
+func TestMountBlockCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-fuse-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	blockCache, err = OpenBlockCache(dir, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { blockCache = nil }()
+
+	d, mnt, cleanup := mountTest(t)
+	defer cleanup()
+
+	data := make([]byte, 2*cacheChunkSize+12345)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	name := filepath.Join(mnt, "ipfs", d.AddFile(data))
+
+	for i := 0; i < 2; i++ {
+		if b, err := ioutil.ReadFile(name); err != nil || !bytes.Equal(b, data) {
+			t.Errorf("read %d: %d bytes, %v", i, len(b), err)
+		}
+	}
+	blockCache.mu.Lock()
+	size := blockCache.size
+	blockCache.mu.Unlock()
+	if size != int64(len(data)) {
+		t.Errorf("cache holds %d bytes, expected %d", size, len(data))
+	}
+}
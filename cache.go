@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+)
+
+var flagEntryTimeout = flag.Duration("entry-timeout", time.Second, "how long the kernel may cache directory entries in MFS")
+var flagAttrTimeout = flag.Duration("attr-timeout", time.Second, "how long file attributes in MFS may be cached")
+var flagNegativeTimeout = flag.Duration("negative-timeout", 0, "how long the kernel may cache the absence of a file in MFS")
+
+// immutableTimeout is how long the kernel may cache anything under /ipfs,
+// which can never change.
+const immutableTimeout = 365 * 24 * time.Hour
+
+// fsConn is used to send cache invalidations to the kernel.
+var fsConn *nodefs.FileSystemConnector
+
+// stat returns the attributes of n, from the cache if they are recent enough.
+func (n *UnixFSNode) stat(ctx context.Context) (*UnixFSStat, error) {
+	n.mu.Lock()
+	stat, age := n.cached, time.Since(n.cachedAt)
+	n.mu.Unlock()
+
+	if stat != nil && age < *flagAttrTimeout {
+		return stat, nil
+	}
+
+	// Not FastStat, which has no mode or mtime for directories.
+	stat, err := n.Backend.Stat(ctx, n.Path())
+	if err != nil || stat == nil {
+		return stat, err
+	}
+	n.setStat(stat)
+	return stat, nil
+}
+
+func (n *UnixFSNode) setStat(stat *UnixFSStat) {
+	n.mu.Lock()
+	n.cached, n.cachedAt = stat, time.Now()
+	n.mu.Unlock()
+}
+
+// invalidate forgets the cached attributes of n, here and in the kernel.
+func (n *UnixFSNode) invalidate() {
+	n.mu.Lock()
+	n.cached = nil
+	n.mu.Unlock()
+
+	notify(func() { fsConn.FileNotify(n.Inode(), -1, 0) })
+}
+
+// notify sends a notification to the kernel. Notifications are sent from a
+// new goroutine, as the kernel may be holding locks that it needs to process
+// them until the current operation returns.
+func notify(f func()) {
+	if fsConn != nil {
+		go f()
+	}
+}
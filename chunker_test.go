@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// xorshiftData returns n bytes that do not repeat, unlike the usual test
+// data, so that content-defined chunkers find boundaries in them.
+func xorshiftData(n int) []byte {
+	data := make([]byte, n)
+	x := uint32(1)
+	for i := range data {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		data[i] = byte(x >> 24)
+	}
+	return data
+}
+
+func TestSplitter(t *testing.T) {
+	// The lengths are those of ipfs add --chunker for the same data.
+	for _, test := range []struct {
+		chunker string
+		size    int
+		lengths []int
+	}{
+		{"size-1000", 2500, []int{1000, 1000, 500}},
+		{"size-1000", 2000, []int{1000, 1000}},
+		{"rabin-16-32-64", 300, []int{64, 41, 27, 40, 30, 64, 28, 6}},
+		{"rabin-min:16-avg:32-max:64", 300, []int{64, 41, 27, 40, 30, 64, 28, 6}},
+		{"rabin-4096", 20000, []int{3665, 2897, 6144, 1459, 5835}},
+		{"rabin", 1 << 20, []int{103947, 293446, 308569, 247214, 95400}},
+		{"buzhash", 1 << 20, []int{239369, 353704, 252423, 183284, 19796}},
+		{"buzhash", 1000, []int{1000}},
+		{"rabin", 0, nil},
+	} {
+		data := xorshiftData(test.size)
+		s, err := newSplitter(bytes.NewReader(data), test.chunker)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lengths []int
+		var joined []byte
+		for {
+			chunk, err := s.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			lengths = append(lengths, len(chunk))
+			joined = append(joined, chunk...)
+		}
+		if !reflect.DeepEqual(lengths, test.lengths) || !bytes.Equal(joined, data) {
+			t.Errorf("%s on %d bytes: got chunks of %v, expected %v", test.chunker, test.size, lengths, test.lengths)
+		}
+	}
+}
+
+func TestCheckChunker(t *testing.T) {
+	for _, chunker := range []string{"size-262144", "size-1048576", "rabin", "rabin-4096", "rabin-16-32-64", "rabin-min:100-avg:200-max:300", "buzhash"} {
+		if err := checkChunker(chunker); err != nil {
+			t.Errorf("%s: %v", chunker, err)
+		}
+	}
+	for _, chunker := range []string{"", "size-0", "size-1048577", "size-x", "rabin-30", "rabin-1048576", "rabin-15-32-64", "rabin-64-32-16", "rabin-16-32-2000000", "rabin-avg:16-32-64", "rabin-1-2", "buzhash-1"} {
+		if err := checkChunker(chunker); err == nil {
+			t.Errorf("%s accepted", chunker)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+var flagTimeout = flag.Duration("timeout", 30*time.Second, "maximum time for the IPFS daemon to answer a metadata operation (0 for no limit)")
+var flagIOTimeout = flag.Duration("io-timeout", 5*time.Minute, "maximum time for the IPFS daemon to answer a read or write (0 for no limit)")
+
+// opContext returns a context for a single FUSE operation. It is cancelled
+// when the kernel interrupts the operation or after timeout has passed.
+// ctx may be nil for operations that go-fuse does not give a context to.
+func opContext(ctx *fuse.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	var parent context.Context = context.Background()
+	if ctx != nil && ctx.Cancel != nil {
+		parent = ctx
+	}
+
+	if timeout > 0 {
+		return context.WithTimeout(parent, timeout)
+	}
+	return context.WithCancel(parent)
+}
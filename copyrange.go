@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// maxCopyLength is the most CopyFileRange copies at once.
+const maxCopyLength = math.MaxUint32 &^ 4095
+
+// CopyFileRange copies within the daemon instead of through the kernel. A
+// copy of a whole file into an MFS file that is no larger becomes a
+// files/cp, so it shares the blocks of the source; other ranges are
+// streamed from the daemon straight back into the destination.
+//
+// nodefs answers copy_file_range with ENOSYS, after which the kernel never
+// asks again. Requests that cannot be handled here are answered with
+// EOPNOTSUPP instead, which makes the kernel copy through Read and Write
+// this time only.
+//
+// FICLONE, which cp --reflink=always uses, never gets this far: the go-fuse
+// server answers every ioctl with ENOSYS itself.
+func (fs *rawFS) CopyFileRange(cancel <-chan struct{}, in *fuse.CopyFileRangeIn) (uint32, fuse.Status) {
+	notSupported := fuse.Status(syscall.EOPNOTSUPP)
+
+	srcNode, srcFile := fs.resolve(in.NodeId, &in.FhIn)
+	dstNode, dstFile := fs.resolve(in.NodeIdOut, &in.FhOut)
+	dst, ok := dstNode.(*UnixFSNode)
+	if !ok || in.Flags != 0 {
+		return 0, notSupported
+	}
+	if _, ok := dstFile.(*UnixFSFile); !ok {
+		return 0, notSupported
+	}
+
+	c, cancelTimeout := opContext(&fuse.Context{Caller: in.Caller, Cancel: cancel}, *flagIOTimeout)
+	defer cancelTimeout()
+
+	var src string
+	if f, ok := srcFile.(*ReadOnlyFile); ok {
+		// A snapshot keeps reading the version it was opened at.
+		src = "/ipfs/" + f.Hash
+	} else {
+		switch n := srcNode.(type) {
+		case *IPFSNode:
+			src = "/ipfs/" + n.Hash
+		case *UnixFSNode:
+			n.flushWrites(c)
+			if err := n.commitSpool(c); err != nil {
+				return 0, errorStatus(c, err, "CopyFileRange", n.Path())
+			}
+			src = n.Path()
+		default:
+			return 0, notSupported
+		}
+	}
+
+	srcStat, err := dst.Backend.Stat(c, src)
+	if err != nil {
+		return 0, errorStatus(c, err, "CopyFileRange", src)
+	}
+	if srcStat == nil {
+		return 0, fuse.ENOENT
+	}
+	if srcStat.Type != "file" {
+		return 0, fuse.EINVAL
+	}
+
+	dst.flushWrites(c)
+	dstStat, err := dst.Backend.Stat(c, dst.Path())
+	if err != nil {
+		return 0, errorStatus(c, err, "CopyFileRange", dst.Path())
+	}
+	if dstStat == nil {
+		return 0, fuse.ENOENT
+	}
+	dstSize := dstStat.Size
+	if s := dst.filledSpool(); s != nil {
+		if fi, err := s.file.Stat(); err == nil {
+			dstSize = uint64(fi.Size())
+		}
+	}
+
+	// The reply only has 32 bits for the length. The kernel asks again for
+	// the rest of a larger copy, and page-sized pieces keep it aligned.
+	length := in.Len
+	if length > maxCopyLength {
+		length = maxCopyLength
+	}
+
+	var written int64
+	whole := in.OffIn == 0 && in.OffOut == 0 && length >= srcStat.Size && dstSize <= srcStat.Size
+	if whole {
+		err = dst.replaceWith(c, src)
+		written = int64(srcStat.Size)
+	} else if in.OffIn < srcStat.Size {
+		written, err = dst.copyRange(c, src, int64(in.OffIn), int64(in.OffOut), int64(length))
+	}
+	if err == nil && written > 0 {
+		dst.modify()
+		// A spool file gets its mtime when it is committed.
+		if whole || dst.getSpool() == nil {
+			dst.stampModified(c)
+		}
+	}
+	dst.resetReadahead()
+	dst.invalidate()
+	if err != nil {
+		return uint32(written), errorStatus(c, err, "CopyFileRange", src, dst.Path())
+	}
+	return uint32(written), fuse.OK
+}
+
+// replaceWith makes n a copy of the file at src with files/cp. If n has a
+// spool file, it is emptied, so that it is downloaded again from the copy
+// when it is next needed.
+func (n *UnixFSNode) replaceWith(ctx context.Context, src string) error {
+	n.spoolMu.Lock()
+	defer n.spoolMu.Unlock()
+
+	if err := replaceFile(ctx, n.Backend, src, n.Path(), false); err != nil {
+		return err
+	}
+	if s := n.getSpool(); s != nil {
+		n.mu.Lock()
+		s.filled = false
+		n.mu.Unlock()
+		s.dirty = false
+		s.pathMu.Lock()
+		os.Remove(s.file.Name() + ".path")
+		s.path = ""
+		s.pathMu.Unlock()
+		return s.file.Truncate(0)
+	}
+	return nil
+}
+
+// copyRange copies up to length bytes from offset off of the file at src to
+// offset dstOff of n, and returns how many bytes it copied.
+func (n *UnixFSNode) copyRange(ctx context.Context, src string, off, dstOff, length int64) (int64, error) {
+	var r io.ReadCloser
+	var err error
+	if strings.HasPrefix(src, "/ipfs/") {
+		r, err = n.Backend.Cat(ctx, src, off, length)
+	} else {
+		r, err = n.Backend.Read(ctx, src, off, length)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	if s := n.getSpool(); s != nil {
+		buf := make([]byte, 1<<20)
+		var written int64
+		for {
+			m, err := readFull(r, buf)
+			if m > 0 {
+				if err := n.writeSpool(ctx, s, buf[:m], dstOff+written); err != nil {
+					return written, err
+				}
+				written += int64(m)
+			}
+			if err != nil || m < len(buf) {
+				return written, err
+			}
+		}
+	}
+
+	cr := &countingReader{r: r}
+	err = n.Backend.Write(ctx, n.Path(), cr, WriteOptions{Offset: dstOff, DAG: n.dagOptions()})
+	return cr.n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var flagLocalDAG = flag.Bool("local-dag", false, "build the DAG of files locally and upload the blocks in batches when a whole file is written at once: files committed from -spool-dir and files truncated to a smaller size (needs -spool-dir; other writes still use files/write)")
+var flagChunker = flag.String("chunker", defaultChunker, "chunker for files written to MFS, as for ipfs add: size-<bytes>, rabin, rabin-<avg>, rabin-<min>-<avg>-<max> or buzhash; any other than the default needs -local-dag and -spool-dir")
+var flagCIDVersion = flag.Int("cid-version", 0, "CID version for files and directories created in MFS")
+var flagHash = flag.String("hash", "sha2-256", "hash function for files and directories created in MFS")
+var flagRawLeaves = flag.Bool("raw-leaves", true, "use raw blocks for the leaves of files written to MFS")
+
+// defaultChunker is what files/write always uses; it has no option to
+// change it.
+const defaultChunker = "size-262144"
+
+// DAGOptions control how the content of a file is turned into a DAG.
+type DAGOptions struct {
+	Chunker    string
+	CIDVersion int
+	Hash       string
+	RawLeaves  bool
+}
+
+func defaultDAGOptions() DAGOptions {
+	return DAGOptions{
+		Chunker:    *flagChunker,
+		CIDVersion: *flagCIDVersion,
+		Hash:       *flagHash,
+		RawLeaves:  *flagRawLeaves,
+	}
+}
+
+// dagXAttrs are the extended attributes that show the DAGOptions in effect
+// for a file or directory. Setting them on a directory overrides the
+// settings for everything created below it until the filesystem is
+// unmounted; overrides are not stored anywhere and do not survive a
+// remount. They are kept by path in dagOverrides, since the node of the
+// directory goes away when the kernel forgets it.
+var dagXAttrs = []string{
+	"user.ipfs-chunker",
+	"user.ipfs-cid-version",
+	"user.ipfs-hash-function",
+	"user.ipfs-raw-leaves",
+}
+
+func isDAGXAttr(attr string) bool {
+	for _, a := range dagXAttrs {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the value of one of dagXAttrs.
+func (opts DAGOptions) get(attr string) string {
+	switch attr {
+	case "user.ipfs-chunker":
+		return opts.Chunker
+	case "user.ipfs-cid-version":
+		return strconv.Itoa(opts.CIDVersion)
+	case "user.ipfs-hash-function":
+		return opts.Hash
+	case "user.ipfs-raw-leaves":
+		return strconv.FormatBool(opts.RawLeaves)
+	}
+	return ""
+}
+
+// set changes the setting for one of dagXAttrs.
+func (opts *DAGOptions) set(attr, value string) error {
+	switch attr {
+	case "user.ipfs-chunker":
+		if err := checkChunker(value); err != nil {
+			return err
+		}
+		opts.Chunker = value
+	case "user.ipfs-cid-version":
+		v, err := strconv.Atoi(value)
+		if err != nil || (v != 0 && v != 1) {
+			return fmt.Errorf("invalid CID version %q", value)
+		}
+		opts.CIDVersion = v
+	case "user.ipfs-hash-function":
+		if value == "" {
+			return fmt.Errorf("invalid hash function %q", value)
+		}
+		opts.Hash = value
+	case "user.ipfs-raw-leaves":
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid raw leaves setting %q", value)
+		}
+		opts.RawLeaves = v
+	}
+	return nil
+}
+
+// check reports settings that would not take effect. Only files built by
+// writeFile can use another chunker than the default, so every write has to
+// go through it.
+func (opts DAGOptions) check() error {
+	if err := checkChunker(opts.Chunker); err != nil {
+		return err
+	}
+	if opts.Chunker != defaultChunker && (!*flagLocalDAG || *flagSpoolDir == "" || opts.Hash != "sha2-256") {
+		return fmt.Errorf("chunker %s needs -local-dag, -spool-dir and the sha2-256 hash function", opts.Chunker)
+	}
+	return nil
+}
+
+// dagOverrides holds the settings changed with SetXAttr, by MFS path.
+var dagOverrides = struct {
+	sync.Mutex
+	byPath map[string]map[string]string
+}{byPath: make(map[string]map[string]string)}
+
+// dagOptions returns the settings for files written in n: the mount-wide
+// flags, with the overrides of n and each of its parents applied.
+func (n *UnixFSNode) dagOptions() DAGOptions {
+	var paths []string
+	for p := n.Path(); ; p = path.Dir(p) {
+		paths = append(paths, p)
+		if p == "/" {
+			break
+		}
+	}
+
+	dagOverrides.Lock()
+	defer dagOverrides.Unlock()
+
+	opts := defaultDAGOptions()
+	for i := len(paths) - 1; i >= 0; i-- {
+		for attr, value := range dagOverrides.byPath[paths[i]] {
+			opts.set(attr, value)
+		}
+	}
+	return opts
+}
+
+func setOverride(p, attr, value string) {
+	dagOverrides.Lock()
+	defer dagOverrides.Unlock()
+
+	if dagOverrides.byPath[p] == nil {
+		dagOverrides.byPath[p] = make(map[string]string)
+	}
+	dagOverrides.byPath[p][attr] = value
+}
+
+// removeOverride removes an override and reports whether there was one.
+func removeOverride(p, attr string) bool {
+	dagOverrides.Lock()
+	defer dagOverrides.Unlock()
+
+	if _, ok := dagOverrides.byPath[p][attr]; !ok {
+		return false
+	}
+	delete(dagOverrides.byPath[p], attr)
+	if len(dagOverrides.byPath[p]) == 0 {
+		delete(dagOverrides.byPath, p)
+	}
+	return true
+}
+
+// moveOverrides moves the overrides of oldPath and everything below it to
+// newPath, replacing those of newPath and everything below it. An empty
+// newPath drops them.
+func moveOverrides(oldPath, newPath string) {
+	dagOverrides.Lock()
+	defer dagOverrides.Unlock()
+
+	moved := make(map[string]map[string]string)
+	for p, overrides := range dagOverrides.byPath {
+		if isBelow(p, oldPath) {
+			moved[newPath+strings.TrimPrefix(p, oldPath)] = overrides
+			delete(dagOverrides.byPath, p)
+		} else if newPath != "" && isBelow(p, newPath) {
+			delete(dagOverrides.byPath, p)
+		}
+	}
+	if newPath == "" {
+		return
+	}
+	for p, overrides := range moved {
+		dagOverrides.byPath[p] = overrides
+	}
+}
+
+// isBelow reports whether the MFS path p is dir or inside it.
+func isBelow(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// blockBatchSize is the amount of block data sent in each block/put request.
+const blockBatchSize = 4 << 20
+
+type blockBatch struct {
+	codec  string
+	blocks [][]byte
+	size   int
+}
+
+// importFile builds the DAG for r locally, uploads it and returns the CID
+// of its root.
+func importFile(ctx context.Context, b Backend, r io.Reader, opts DAGOptions) (string, error) {
+	batches := map[uint64]*blockBatch{
+		codecRaw:   {codec: "raw"},
+		codecDagPB: {codec: "dag-pb"},
+	}
+	send := func(batch *blockBatch) error {
+		if len(batch.blocks) == 0 {
+			return nil
+		}
+		err := b.PutBlocks(ctx, batch.codec, batch.blocks)
+		batch.blocks, batch.size = nil, 0
+		return err
+	}
+
+	root, err := buildFile(r, opts, func(codec uint64, block []byte) error {
+		batch := batches[codec]
+		batch.blocks = append(batch.blocks, append([]byte(nil), block...))
+		batch.size += len(block)
+		if batch.size >= blockBatchSize {
+			return send(batch)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Leaves first, so that the root is only complete once everything
+	// below it has arrived.
+	if err := send(batches[codecRaw]); err != nil {
+		return "", err
+	}
+	if err := send(batches[codecDagPB]); err != nil {
+		return "", err
+	}
+	return root, nil
+}
+
+// localDAG reports whether writeFile builds files with opts itself. Only the
+// default hash function is implemented here.
+func localDAG(opts DAGOptions) bool {
+	return *flagLocalDAG && opts.Hash == "sha2-256"
+}
+
+// writeFile replaces the content of the MFS file at path with r. If create
+// is false, the file must already exist.
+func writeFile(ctx context.Context, b Backend, p string, r io.Reader, create bool, opts DAGOptions) error {
+	if !localDAG(opts) {
+		return b.Write(ctx, p, r, WriteOptions{Create: create, Truncate: true, DAG: opts})
+	}
+
+	root, err := importFile(ctx, b, r, opts)
+	if err != nil {
+		return err
+	}
+	return replaceFile(ctx, b, "/ipfs/"+root, p, create)
+}
+
+// writeFileAside is writeFile for an existing file and content that can fail
+// partway, such as a stream from the daemon. files/write truncates the file
+// before it reads any of r, so the content is written to a hidden file
+// first, and a failure leaves p as it was.
+func writeFileAside(ctx context.Context, b Backend, p string, r io.Reader, opts DAGOptions) error {
+	if localDAG(opts) {
+		// Nothing is written until the DAG is complete.
+		return writeFile(ctx, b, p, r, false, opts)
+	}
+
+	tmp, err := hiddenPath(ctx, b, p)
+	if err != nil {
+		return err
+	}
+	err = b.Write(ctx, tmp, r, WriteOptions{Create: true, Truncate: true, DAG: opts})
+	if err == nil {
+		err = replaceFile(ctx, b, tmp, p, false)
+	}
+	removeHidden(ctx, b, tmp)
+	return err
+}
+
+// replaceFile makes the MFS file at p a copy of src, keeping the mode and
+// mtime of the file it replaces. files/cp will not replace an existing file
+// and files/mv will not either, so src is copied into instanceDir first,
+// and the old file is moved aside there and only removed once the copy has
+// taken its place. Other clients of MFS may briefly see p missing.
+func replaceFile(ctx context.Context, b Backend, src, p string, create bool) error {
+	old, err := b.Stat(ctx, p)
+	if err != nil {
+		return err
+	}
+	if old == nil && create {
+		return b.Copy(ctx, src, p)
+	}
+	if old != nil && old.Type == "file" && old.Size == 0 {
+		// Nothing is lost if an empty file, such as one that was just
+		// created, is removed before the copy.
+		return replaceEmptyFile(ctx, b, old, src, p)
+	}
+
+	tmp, err := hiddenPath(ctx, b, p)
+	if err != nil {
+		return err
+	}
+	if err := b.Copy(ctx, src, tmp); err != nil {
+		return err
+	}
+	if old != nil {
+		err = copyMetadata(ctx, b, old, tmp)
+	}
+	var aside string
+	if err == nil {
+		aside, err = hiddenPath(ctx, b, p)
+	}
+	if err == nil {
+		err = b.Move(ctx, p, aside)
+	}
+	if err != nil {
+		removeHidden(ctx, b, tmp)
+		return err
+	}
+	if err := b.Move(ctx, tmp, p); err != nil {
+		if e := b.Move(ctx, aside, p); e != nil {
+			log.Println("Cannot move", aside, "back to", p+":", e)
+		}
+		removeHidden(ctx, b, tmp)
+		return err
+	}
+	removeHidden(ctx, b, aside)
+	return nil
+}
+
+// replaceEmptyFile is replaceFile for an empty file, which is removed and
+// copied over directly. If the copy fails, the empty file is put back.
+func replaceEmptyFile(ctx context.Context, b Backend, old *UnixFSStat, src, p string) error {
+	if err := b.Remove(ctx, p, false); err != nil {
+		return err
+	}
+	err := b.Copy(ctx, src, p)
+	if err != nil {
+		if e := b.Write(ctx, p, strings.NewReader(""), WriteOptions{Create: true}); e != nil {
+			log.Println("Cannot recreate", p+":", e)
+			return err
+		}
+	}
+	if e := copyMetadata(ctx, b, old, p); err == nil {
+		err = e
+	}
+	return err
+}
+
+// copyMetadata gives the MFS node at p the mode and mtime in stat, if it has
+// them.
+func copyMetadata(ctx context.Context, b Backend, stat *UnixFSStat, p string) error {
+	if stat.Mode != 0 {
+		if err := b.Chmod(ctx, p, unixMode(stat.Mode)); err != nil {
+			return err
+		}
+	}
+	if stat.Mtime != 0 {
+		if err := b.Touch(ctx, p, time.Unix(stat.Mtime, stat.MtimeNsecs)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+// daemonErrors maps fragments of daemon error messages to errnos. Different
+// versions of the daemon word the same failure differently, so each errno
+// may have several entries. The first match wins.
+var daemonErrors = []struct {
+	message string
+	errno   syscall.Errno
+}{
+	{"file does not exist", syscall.ENOENT},
+	{"no such file or directory", syscall.ENOENT},
+	{"no link named", syscall.ENOENT},
+	{"merkledag: not found", syscall.ENOENT},
+	{"could not resolve name", syscall.ENOENT},
+	{"already exists", syscall.EEXIST},
+	{"already has entry by that name", syscall.EEXIST},
+	{"not a directory", syscall.ENOTDIR},
+	{"is a directory", syscall.EISDIR},
+	{"was not a file", syscall.EISDIR},
+	{"directory not empty", syscall.ENOTEMPTY},
+	{"no space left on device", syscall.ENOSPC},
+	{"storage limit exceeded", syscall.ENOSPC},
+	{"offset was past end of file", syscall.EINVAL},
+	{"cannot delete root", syscall.EBUSY},
+}
+
+// errno classifies an error from a Backend. Errors that do not match any
+// known condition are reported as EIO.
+func errno(err error) syscall.Errno {
+	for {
+		switch e := err.(type) {
+		case *shell.Error:
+			msg := strings.ToLower(e.Message)
+			for _, de := range daemonErrors {
+				if strings.Contains(msg, de.message) {
+					return de.errno
+				}
+			}
+			return syscall.EIO
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			if e.Timeout() {
+				return syscall.ETIMEDOUT
+			}
+			if e.Op == "dial" {
+				return syscall.ENOTCONN
+			}
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case syscall.Errno:
+			switch e {
+			case syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ECONNABORTED, syscall.EPIPE, syscall.ENETUNREACH, syscall.EHOSTUNREACH:
+				return syscall.ENOTCONN
+			case syscall.ETIMEDOUT:
+				return syscall.ETIMEDOUT
+			}
+			return syscall.EIO
+		default:
+			if err == context.DeadlineExceeded {
+				return syscall.ETIMEDOUT
+			}
+			if err == context.Canceled {
+				return syscall.EINTR
+			}
+			return syscall.EIO
+		}
+	}
+}
+
+func isNotExist(err error) bool {
+	return errno(err) == syscall.ENOENT
+}
+
+func isExist(err error) bool {
+	return errno(err) == syscall.EEXIST
+}
+
+// errorStatus returns the status for a FUSE operation that failed with err.
+// If the operation timed out or was interrupted, that takes precedence.
+// Unexpected errors are logged along with v, which should describe the
+// operation.
+func errorStatus(ctx context.Context, err error, v ...interface{}) fuse.Status {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return fuse.Status(syscall.ETIMEDOUT)
+	case context.Canceled:
+		return fuse.EINTR
+	}
+
+	e := errno(err)
+	if e == syscall.EIO || e == syscall.ENOTCONN {
+		log.Println(append(v, err)...)
+	}
+	return fuse.Status(e)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+func TestErrno(t *testing.T) {
+	for _, tt := range []struct {
+		message string
+		errno   syscall.Errno
+	}{
+		{"file does not exist", syscall.ENOENT},
+		{`no link named "missing" under QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn`, syscall.ENOENT},
+		{"file already exists", syscall.EEXIST},
+		{"directory already has entry by that name", syscall.EEXIST},
+		{"/a/b is a directory, use -r to remove directories", syscall.EISDIR},
+		{"/a/b was not a file", syscall.EISDIR},
+		{"b was not a directory", syscall.ENOTDIR},
+		{"something unexpected", syscall.EIO},
+	} {
+		if e := errno(&shell.Error{Message: tt.message}); e != tt.errno {
+			t.Errorf("%q: got %v, want %v", tt.message, e, tt.errno)
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	_, err = NewHTTPBackend(shell.NewShell(addr)).Stat(context.Background(), "/")
+	if e := errno(err); e != syscall.ENOTCONN {
+		t.Errorf("daemon not running: got %v (%v), want ENOTCONN", e, err)
+	}
+}
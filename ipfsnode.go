@@ -1,19 +1,23 @@
 package main
 
 import (
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 )
 
 type IPFSNode struct {
 	nodefs.Node
+	Backend Backend
 	Hash    string
 	Stat    *UnixFSStat
 	Entries *UnixFSList
+	Target  string // if Stat.Type is "symlink"
 }
 
 func (n *IPFSNode) Lookup(out *fuse.Attr, name string, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
-	return lookupIPFS(n.Inode(), out, n.Hash+"/"+name, ctx)
+	return lookupIPFS(n.Backend, n.Inode(), out, n.Hash+"/"+name, ctx)
 }
 
 func (n *IPFSNode) Open(flags uint32, ctx *fuse.Context) (nodefs.File, fuse.Status) {
@@ -21,7 +25,29 @@ func (n *IPFSNode) Open(flags uint32, ctx *fuse.Context) (nodefs.File, fuse.Stat
 		return nil, fuse.EISDIR
 	}
 
-	return &ReadOnlyFile{File: nodefs.NewDefaultFile(), Hash: n.Hash}, fuse.OK
+	// The contents of a CID never change, so the kernel can keep cached
+	// pages from previous opens.
+	return &nodefs.WithFlags{
+		File:      &ReadOnlyFile{File: nodefs.NewDefaultFile(), Backend: n.Backend, Hash: n.Hash},
+		FuseFlags: fuse.FOPEN_KEEP_CACHE,
+	}, fuse.OK
+}
+
+// Readlink returns the target as it is. The kernel resolves relative
+// targets from the directory the symlink is in, so they stay inside the
+// DAG as long as they do not climb out of its root.
+func (n *IPFSNode) Readlink(ctx *fuse.Context) ([]byte, fuse.Status) {
+	if n.Stat.Type != "symlink" {
+		return nil, fuse.EINVAL
+	}
+	return []byte(n.Target), fuse.OK
+}
+
+func (n *IPFSNode) Read(file nodefs.File, dest []byte, off int64, ctx *fuse.Context) (fuse.ReadResult, fuse.Status) {
+	if f, ok := file.(*ReadOnlyFile); ok {
+		return f.read(ctx, dest, off)
+	}
+	return n.Node.Read(file, dest, off, ctx)
 }
 
 func (n *IPFSNode) OpenDir(ctx *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
@@ -32,9 +58,12 @@ func (n *IPFSNode) OpenDir(ctx *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
 	entries := make([]fuse.DirEntry, len(n.Entries.Entries))
 	for i, e := range n.Entries.Entries {
 		var mode uint32
-		if e.Type == Directory {
+		switch e.Type {
+		case Directory:
 			mode = fuse.S_IFDIR
-		} else {
+		case Symlink:
+			mode = fuse.S_IFLNK
+		default:
 			mode = fuse.S_IFREG
 		}
 		entries[i] = fuse.DirEntry{
@@ -47,13 +76,17 @@ func (n *IPFSNode) OpenDir(ctx *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
 }
 
 func (n *IPFSNode) GetAttr(out *fuse.Attr, file nodefs.File, ctx *fuse.Context) fuse.Status {
-	out.Mtime = 1
-	out.Ctime = 1
+	if answerProbe(ctx, n, file) {
+		return fuse.OK
+	}
 
 	out.Mode = 0444
 	if n.Entries != nil {
 		out.Mode |= 0111 | fuse.S_IFDIR
 		out.Size = uint64(len(n.Entries.Entries))
+	} else if n.Stat.Type == "symlink" {
+		out.Mode |= fuse.S_IFLNK
+		out.Size = uint64(len(n.Target))
 	} else {
 		out.Mode |= fuse.S_IFREG
 		out.Size = n.Stat.Size
@@ -61,6 +94,11 @@ func (n *IPFSNode) GetAttr(out *fuse.Attr, file nodefs.File, ctx *fuse.Context)
 
 	out.Blocks = out.Size
 	out.Blksize = 1
+	readOnlyMetadataToAttr(out, n.Stat)
 
 	return fuse.OK
 }
+
+func (n *IPFSNode) Rename(oldName string, newParent nodefs.Node, newName string, ctx *fuse.Context) fuse.Status {
+	return fuse.Status(syscall.EXDEV)
+}
@@ -1,27 +1,30 @@
 package main
 
 import (
-	"context"
-	"log"
+	"syscall"
+
 	"path"
 
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 )
 
 type IPFSRootNode struct {
 	nodefs.Node
+	Backend Backend
 }
 
 func (n *IPFSRootNode) Lookup(out *fuse.Attr, name string, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
-	return lookupIPFS(n.Inode(), out, name, ctx)
+	return lookupIPFS(n.Backend, n.Inode(), out, name, ctx)
 }
 
-func lookupIPFS(inode *nodefs.Inode, out *fuse.Attr, name string, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
-	stat, err := Stat(context.TODO(), "/ipfs/"+name)
+func lookupIPFS(backend Backend, inode *nodefs.Inode, out *fuse.Attr, name string, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	c, cancel := opContext(ctx, *flagTimeout)
+	defer cancel()
+
+	stat, err := backend.Stat(c, "/ipfs/"+name)
 	if err != nil {
-		log.Println("Lookup", "/ipfs/"+name, err)
-		return nil, fuse.EIO
+		return nil, errorStatus(c, err, "Lookup", "/ipfs/"+name)
 	}
 	if stat == nil {
 		inode.RmChild(path.Base(name))
@@ -29,18 +32,16 @@ func lookupIPFS(inode *nodefs.Inode, out *fuse.Attr, name string, ctx *fuse.Cont
 	}
 
 	var entries *UnixFSList
-	out.Mtime = 1
-	out.Ctime = 1
+	var target string
 	out.Size = stat.Size
 	out.Blocks = out.Size
 	out.Blksize = 1
 	out.Mode = 0444
 	if stat.Type == "directory" {
 		out.Mode |= 0111 | fuse.S_IFDIR
-		entries, err = ListImmutable(context.TODO(), "/ipfs/"+name+"/")
+		entries, err = backend.ListImmutable(c, "/ipfs/"+name+"/")
 		if err != nil {
-			log.Println("Lookup", "/ipfs/"+name, err)
-			return nil, fuse.EIO
+			return nil, errorStatus(c, err, "Lookup", "/ipfs/"+name)
 		}
 		if entries == nil {
 			inode.RmChild(path.Base(name))
@@ -50,13 +51,27 @@ func lookupIPFS(inode *nodefs.Inode, out *fuse.Attr, name string, ctx *fuse.Cont
 		out.Blocks = out.Size
 	} else if stat.Type == "file" {
 		out.Mode |= fuse.S_IFREG
+	} else if stat.Type == "symlink" {
+		block, err := backend.GetBlock(c, stat.Hash)
+		if err == nil {
+			target, err = symlinkTarget(block)
+		}
+		if err != nil {
+			return nil, errorStatus(c, err, "Lookup", "/ipfs/"+name)
+		}
+		out.Mode |= fuse.S_IFLNK
+		out.Size = uint64(len(target))
+		out.Blocks = out.Size
 	}
+	readOnlyMetadataToAttr(out, stat)
 
 	return inode.NewChild(name, out.IsDir(), &IPFSNode{
 		Node:    nodefs.NewDefaultNode(),
+		Backend: backend,
 		Hash:    stat.Hash,
 		Stat:    stat,
 		Entries: entries,
+		Target:  target,
 	}), fuse.OK
 }
 
@@ -76,3 +91,9 @@ func (n *IPFSRootNode) GetAttr(out *fuse.Attr, file nodefs.File, ctx *fuse.Conte
 	out.Mode = 0111 | fuse.S_IFDIR
 	return fuse.OK
 }
+
+// Rename returns EXDEV for anything in /ipfs, which cannot be changed, so
+// that mv copies it instead of giving up.
+func (n *IPFSRootNode) Rename(oldName string, newParent nodefs.Node, newName string, ctx *fuse.Context) fuse.Status {
+	return fuse.Status(syscall.EXDEV)
+}
@@ -0,0 +1,744 @@
+// Package ipfstest provides an in-memory stand-in for the IPFS daemon's HTTP
+// RPC API, for use in tests.
+//
+// Only the commands used by ipfs-fuse are implemented. Errors use the same
+// messages as the real daemon where ipfs-fuse depends on them.
+package ipfstest
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	pathutil "path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNotExist = errors.New("file does not exist")
+
+// Daemon is a fake IPFS daemon with an in-memory MFS tree and block store.
+type Daemon struct {
+	mu     sync.Mutex
+	root   *node
+	blocks map[string]*node
+	raw    map[string]rawBlock
+	names  map[string]string
+	server *httptest.Server
+}
+
+// NewDaemon starts a fake daemon with an empty MFS root. Call Close when done.
+func NewDaemon() *Daemon {
+	d := &Daemon{
+		root:   newDir(),
+		blocks: make(map[string]*node),
+		raw:    make(map[string]rawBlock),
+		names:  make(map[string]string),
+	}
+	d.server = httptest.NewServer(d)
+	return d
+}
+
+// Addr returns the host:port the RPC API is listening on.
+func (d *Daemon) Addr() string {
+	return d.server.Listener.Addr().String()
+}
+
+func (d *Daemon) Close() {
+	d.server.Close()
+}
+
+// AddFile adds an immutable file and returns its hash.
+func (d *Daemon) AddFile(data []byte) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.put(&node{data: data})
+}
+
+// AddFileWithMetadata adds an immutable file with UnixFS 1.5 metadata and
+// returns its hash.
+func (d *Daemon) AddFileWithMetadata(data []byte, mode uint32, mtime time.Time) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.put(&node{data: data, mode: mode, mtime: mtime.Unix(), mtimeNsecs: int64(mtime.Nanosecond())})
+}
+
+// AddDir adds an immutable directory and returns its hash. The links map
+// entry names to the hashes of previously added files or directories.
+func (d *Daemon) AddDir(links map[string]string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dir := newDir()
+	for name, hash := range links {
+		child, ok := d.blocks[hash]
+		if !ok {
+			panic("ipfstest: unknown hash " + hash)
+		}
+		dir.links[name] = child
+	}
+	return d.put(dir)
+}
+
+// AddSymlink adds an immutable symlink and returns its hash.
+func (d *Daemon) AddSymlink(target string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.put(&node{data: []byte(target), symlink: true})
+}
+
+// Publish points /ipns/name at path.
+func (d *Daemon) Publish(name, path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.names[name] = path
+}
+
+type request struct {
+	args []string
+	opts url.Values
+	http *http.Request
+}
+
+func (r *request) arg(i int) string {
+	if i < len(r.args) {
+		return r.args[i]
+	}
+	return ""
+}
+
+func (r *request) bool(names ...string) bool {
+	for _, name := range names {
+		if b, err := strconv.ParseBool(r.opts.Get(name)); err == nil {
+			return b
+		}
+	}
+	return false
+}
+
+func (r *request) int(name string, def int64) (int64, error) {
+	s := r.opts.Get(name)
+	if s == "" {
+		return def, nil
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %q", name, s)
+	}
+	return i, nil
+}
+
+// body returns the contents of the first file in a multipart request.
+func (r *request) body() ([]byte, error) {
+	mr, err := r.http.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	part, err := mr.NextPart()
+	if err != nil {
+		return nil, errors.New("file argument 'data' is required")
+	}
+	defer part.Close()
+	return ioutil.ReadAll(part)
+}
+
+var commands = map[string]func(*Daemon, *request) (interface{}, error){
+	"files/stat":  (*Daemon).filesStat,
+	"files/ls":    (*Daemon).filesLs,
+	"files/read":  (*Daemon).filesRead,
+	"files/write": (*Daemon).filesWrite,
+	"files/mkdir": (*Daemon).filesMkdir,
+	"files/rm":    (*Daemon).filesRm,
+	"files/mv":    (*Daemon).filesMv,
+	"files/flush": (*Daemon).filesFlush,
+	"files/cp":    (*Daemon).filesCp,
+	"block/put":   (*Daemon).blockPut,
+	"block/get":   (*Daemon).blockGet,
+	"files/chmod": (*Daemon).filesChmod,
+	"files/touch": (*Daemon).filesTouch,
+	"ls":          (*Daemon).ls,
+	"cat":         (*Daemon).cat,
+	"resolve":     (*Daemon).resolve,
+}
+
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cmd := strings.TrimPrefix(r.URL.Path, "/api/v0/")
+	f, ok := commands[cmd]
+	if !ok || cmd == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	req := &request{args: q["arg"], opts: q, http: r}
+
+	d.mu.Lock()
+	out, err := f(d, req)
+	d.mu.Unlock()
+
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"Message": err.Error(),
+			"Code":    0,
+			"Type":    "error",
+		})
+		return
+	}
+
+	if b, ok := out.([]byte); ok {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Stream-Output", "1")
+		_, _ = w.Write(b)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// lookup resolves an MFS path or an /ipfs or /ipns path.
+func (d *Daemon) lookup(path string) *node {
+	switch {
+	case strings.HasPrefix(path, "/ipfs/"):
+		hash := strings.TrimPrefix(path, "/ipfs/")
+		rest := ""
+		if i := strings.IndexByte(hash, '/'); i != -1 {
+			hash, rest = hash[:i], hash[i:]
+		}
+		n, ok := d.blocks[hash]
+		if !ok {
+			return nil
+		}
+		return n.walk(rest)
+	case strings.HasPrefix(path, "/ipns/"):
+		name := strings.TrimPrefix(path, "/ipns/")
+		rest := ""
+		if i := strings.IndexByte(name, '/'); i != -1 {
+			name, rest = name[:i], name[i:]
+		}
+		target, ok := d.names[name]
+		if !ok {
+			return nil
+		}
+		return d.lookup(target + rest)
+	default:
+		return d.root.walk(path)
+	}
+}
+
+// lookupMFS resolves a path that has to be in MFS, for commands that change
+// a node in place.
+func (d *Daemon) lookupMFS(path string) *node {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "/ipfs/") || strings.HasPrefix(path, "/ipns/") {
+		return nil
+	}
+	return d.root.walk(path)
+}
+
+// parent returns the directory containing an MFS path and the final path
+// component.
+func (d *Daemon) parent(path string) (*node, string, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, "", errors.New("paths must start with a leading slash")
+	}
+	dir, name := pathutil.Split(pathutil.Clean(path))
+	p := d.root.walk(dir)
+	if p == nil || !p.isDir() {
+		return nil, "", errNotExist
+	}
+	return p, name, nil
+}
+
+type statOutput struct {
+	Hash           string
+	Size           uint64
+	CumulativeSize uint64
+	Blocks         int
+	Type           string
+	Mode           os.FileMode `json:",omitempty"`
+	Mtime          int64       `json:",omitempty"`
+	MtimeNsecs     int64       `json:",omitempty"`
+}
+
+func (d *Daemon) filesStat(r *request) (interface{}, error) {
+	n := d.lookup(r.arg(0))
+	if n == nil {
+		return nil, errNotExist
+	}
+
+	return &statOutput{
+		Hash:           d.put(n),
+		Size:           n.size(),
+		CumulativeSize: n.cumulativeSize(),
+		Blocks:         len(n.links),
+		Type:           n.typeName(),
+		Mode:           n.fileMode(),
+		Mtime:          n.mtime,
+		MtimeNsecs:     n.mtimeNsecs,
+	}, nil
+}
+
+// lsEntry is an entry of files/ls, which does not include the metadata of
+// the entries, even with -l.
+type lsEntry struct {
+	Name string
+	Type int
+	Size uint64
+	Hash string
+}
+
+func (d *Daemon) filesLs(r *request) (interface{}, error) {
+	path := r.arg(0)
+	if path == "" {
+		path = "/"
+	}
+	n := d.lookup(path)
+	if n == nil {
+		return nil, errNotExist
+	}
+	long := r.bool("l", "long")
+
+	entry := func(name string, n *node) lsEntry {
+		e := lsEntry{Name: name}
+		if long {
+			if n.isDir() {
+				e.Type = 1
+			}
+			e.Size = n.size()
+			e.Hash = d.put(n)
+		}
+		return e
+	}
+
+	var out struct {
+		Entries []lsEntry
+	}
+	if !n.isDir() {
+		_, name := pathutil.Split(path)
+		out.Entries = append(out.Entries, entry(name, n))
+		return &out, nil
+	}
+	for _, name := range n.names() {
+		out.Entries = append(out.Entries, entry(name, n.links[name]))
+	}
+	return &out, nil
+}
+
+func (d *Daemon) filesRead(r *request) (interface{}, error) {
+	path := r.arg(0)
+	n := d.lookup(path)
+	if n == nil {
+		return nil, errNotExist
+	}
+	if n.isDir() {
+		return nil, fmt.Errorf("%s was not a file", path)
+	}
+	if n.symlink {
+		return nil, errors.New("cannot currently read symlinks")
+	}
+
+	offset, err := r.int("offset", 0)
+	if err != nil {
+		return nil, err
+	}
+	count, err := r.int("count", -1)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		return nil, errors.New("cannot specify negative offset")
+	}
+	if offset > int64(len(n.data)) {
+		return nil, fmt.Errorf("offset was past end of file (%d > %d)", offset, len(n.data))
+	}
+
+	data := n.data[offset:]
+	if count >= 0 && count < int64(len(data)) {
+		data = data[:count]
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (d *Daemon) filesWrite(r *request) (interface{}, error) {
+	path := r.arg(0)
+	p, name, err := d.parent(path)
+	if err != nil {
+		return nil, err
+	}
+
+	n := p.links[name]
+	if n == nil {
+		if !r.bool("create", "e") {
+			return nil, errNotExist
+		}
+		n = &node{}
+		p.links[name] = n
+	}
+	if n.isDir() {
+		return nil, fmt.Errorf("%s was not a file", path)
+	}
+
+	offset, err := r.int("offset", 0)
+	if err != nil {
+		return nil, err
+	}
+	count, err := r.int("count", -1)
+	if err != nil {
+		return nil, err
+	}
+	// Like Kubo, the file is truncated before the body is read, so a
+	// body that fails partway leaves it cut short.
+	if r.bool("truncate", "t") {
+		n.data = nil
+	}
+	data, err := r.body()
+	if err != nil {
+		return nil, err
+	}
+
+	if offset < 0 {
+		return nil, errors.New("cannot have negative write offset")
+	}
+	if offset > int64(len(n.data)) {
+		return nil, fmt.Errorf("offset was past end of file (%d > %d)", offset, len(n.data))
+	}
+	if count >= 0 && count < int64(len(data)) {
+		data = data[:count]
+	}
+
+	if end := offset + int64(len(data)); end > int64(len(n.data)) {
+		n.data = append(n.data, make([]byte, end-int64(len(n.data)))...)
+	}
+	copy(n.data[offset:], data)
+	return nil, nil
+}
+
+func (d *Daemon) filesMkdir(r *request) (interface{}, error) {
+	path := r.arg(0)
+	if r.bool("parents", "p") {
+		n := d.root
+		for _, name := range strings.Split(path, "/") {
+			if name == "" {
+				continue
+			}
+			child := n.links[name]
+			if child == nil {
+				child = newDir()
+				n.links[name] = child
+			} else if !child.isDir() {
+				return nil, fmt.Errorf("%s was not a directory", name)
+			}
+			n = child
+		}
+		return nil, nil
+	}
+
+	p, name, err := d.parent(path)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" || p.links[name] != nil {
+		return nil, errors.New("file already exists")
+	}
+	p.links[name] = newDir()
+	return nil, nil
+}
+
+func (d *Daemon) filesRm(r *request) (interface{}, error) {
+	path := r.arg(0)
+	if pathutil.Clean(path) == "/" {
+		return nil, errors.New("cannot delete root")
+	}
+	p, name, err := d.parent(path)
+	if err != nil {
+		return nil, err
+	}
+
+	n := p.links[name]
+	if n == nil {
+		return nil, errNotExist
+	}
+	if n.isDir() && !r.bool("recursive", "r") {
+		return nil, fmt.Errorf("%s is a directory, use -r to remove directories", path)
+	}
+	delete(p.links, name)
+	return nil, nil
+}
+
+func (d *Daemon) filesMv(r *request) (interface{}, error) {
+	src, dst := r.arg(0), r.arg(1)
+	sp, sname, err := d.parent(src)
+	if err != nil {
+		return nil, err
+	}
+	n := sp.links[sname]
+	if n == nil {
+		return nil, errNotExist
+	}
+
+	dp, dname, err := d.parent(dst)
+	if err != nil {
+		return nil, err
+	}
+	if target := dp.links[dname]; target != nil {
+		if !target.isDir() {
+			return nil, errors.New("directory already has entry by that name")
+		}
+		// Moving onto a directory moves into it.
+		dp, dname = target, sname
+		if dp.links[dname] != nil {
+			return nil, errors.New("directory already has entry by that name")
+		}
+	}
+
+	delete(sp.links, sname)
+	dp.links[dname] = n
+	return nil, nil
+}
+
+func (d *Daemon) filesCp(r *request) (interface{}, error) {
+	src, dst := r.arg(0), r.arg(1)
+
+	var n *node
+	if strings.HasPrefix(src, "/ipfs/") && !strings.Contains(src[len("/ipfs/"):], "/") {
+		if codec, mh, err := decodeCID(src[len("/ipfs/"):]); err == nil {
+			if n, err = d.buildNode(codec, mh); err != nil && err != errNotExist {
+				return nil, err
+			}
+		}
+	}
+	if n == nil {
+		n = d.lookup(src)
+	}
+	if n == nil {
+		return nil, errNotExist
+	}
+
+	p, name, err := d.parent(dst)
+	if err != nil {
+		return nil, err
+	}
+	if p.links[name] != nil {
+		return nil, errors.New("directory already has entry by that name")
+	}
+	p.links[name] = n.clone()
+	return nil, nil
+}
+
+func (d *Daemon) blockPut(r *request) (interface{}, error) {
+	var codec uint64
+	switch c := r.opts.Get("cid-codec"); c {
+	case "", "raw":
+		codec = codecRaw
+	case "dag-pb":
+		codec = codecDagPB
+	default:
+		return nil, fmt.Errorf("unsupported cid-codec %q", c)
+	}
+	hash := r.opts.Get("mhtype")
+	if hash != "" && hash != "sha2-256" && hash != "sha2-512" {
+		return nil, fmt.Errorf("unsupported mhtype %q", hash)
+	}
+
+	mr, err := r.http.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		Key  string
+		Size int
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(part)
+		part.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		var mh string
+		if hash == "sha2-512" {
+			sum := sha512.Sum512(data)
+			mh = string(append([]byte{0x13, 0x40}, sum[:]...))
+		} else {
+			sum := sha256.Sum256(data)
+			mh = string(append([]byte{0x12, 0x20}, sum[:]...))
+		}
+		d.raw[mh] = rawBlock{codec: codec, data: data}
+
+		key := make([]byte, 1+binary.MaxVarintLen64)
+		key[0] = 1
+		key = append(key[:1+binary.PutUvarint(key[1:], codec)], mh...)
+		out.Key = "b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key))
+		out.Size = len(data)
+	}
+	return &out, nil
+}
+
+// blockGet returns blocks added with block/put as they are. Other nodes
+// only have the UnixFS data of their first block, which is enough for
+// symlinks and small files.
+func (d *Daemon) blockGet(r *request) (interface{}, error) {
+	cid := r.arg(0)
+	if codec, mh, err := decodeCID(cid); err == nil {
+		if block, ok := d.raw[mh]; ok && block.codec == codec {
+			return append([]byte(nil), block.data...), nil
+		}
+	}
+	n, ok := d.blocks[cid]
+	if !ok {
+		return nil, errors.New("block was not found locally (offline): ipld: could not find " + cid)
+	}
+	return encodeNode(n), nil
+}
+
+func (d *Daemon) filesChmod(r *request) (interface{}, error) {
+	mode, err := strconv.ParseUint(r.arg(0), 8, 32)
+	if err != nil || mode&^07777 != 0 {
+		return nil, fmt.Errorf("invalid mode %q", r.arg(0))
+	}
+	n := d.lookupMFS(r.arg(1))
+	if n == nil {
+		return nil, errNotExist
+	}
+	n.mode = uint32(mode)
+	return nil, nil
+}
+
+func (d *Daemon) filesTouch(r *request) (interface{}, error) {
+	mtime, err := r.int("mtime", time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	nsecs, err := r.int("mtime-nsecs", 0)
+	if err != nil {
+		return nil, err
+	}
+	n := d.lookupMFS(r.arg(0))
+	if n == nil {
+		return nil, errNotExist
+	}
+	n.mtime, n.mtimeNsecs = mtime, nsecs
+	return nil, nil
+}
+
+func (d *Daemon) filesFlush(r *request) (interface{}, error) {
+	path := r.arg(0)
+	if path == "" {
+		path = "/"
+	}
+	n := d.lookup(path)
+	if n == nil {
+		return nil, errNotExist
+	}
+
+	return &struct{ Cid string }{d.put(n)}, nil
+}
+
+type lsLink struct {
+	Name string
+	Hash string
+	Size uint64
+	Type int
+}
+
+func (d *Daemon) ls(r *request) (interface{}, error) {
+	path := r.arg(0)
+	n := d.lookup(path)
+	if n == nil {
+		return nil, errNotExist
+	}
+
+	object := struct {
+		Hash  string
+		Links []lsLink
+	}{Hash: path, Links: []lsLink{}}
+	for _, name := range n.names() {
+		child := n.links[name]
+		link := lsLink{
+			Name: name,
+			Hash: d.put(child),
+			Size: child.cumulativeSize(),
+			Type: 2,
+		}
+		if child.isDir() {
+			link.Type = 1
+		} else if child.symlink {
+			link.Type = 4
+		}
+		object.Links = append(object.Links, link)
+	}
+
+	return map[string]interface{}{"Objects": []interface{}{object}}, nil
+}
+
+func (d *Daemon) cat(r *request) (interface{}, error) {
+	path := r.arg(0)
+	if !strings.HasPrefix(path, "/ipfs/") && !strings.HasPrefix(path, "/ipns/") {
+		path = "/ipfs/" + path
+	}
+	n := d.lookup(path)
+	if n == nil {
+		return nil, errNotExist
+	}
+	if n.isDir() {
+		return nil, errors.New("this dag node is a directory")
+	}
+	if n.symlink {
+		return nil, errors.New("cannot currently read symlinks")
+	}
+
+	offset, err := r.int("offset", 0)
+	if err != nil {
+		return nil, err
+	}
+	length, err := r.int("length", -1)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		return nil, errors.New("cannot specify negative offset")
+	}
+	if offset > int64(len(n.data)) {
+		offset = int64(len(n.data))
+	}
+
+	data := n.data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (d *Daemon) resolve(r *request) (interface{}, error) {
+	name := strings.TrimPrefix(r.arg(0), "/ipns/")
+	target, ok := d.names[name]
+	if !ok {
+		return nil, errNotExist
+	}
+
+	return &struct{ Path string }{target}, nil
+}
@@ -0,0 +1,217 @@
+package ipfstest
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// rawBlock is a block added with block/put. Blocks are keyed by multihash,
+// like the daemon's blockstore.
+type rawBlock struct {
+	codec uint64
+	data  []byte
+}
+
+const (
+	codecRaw   = 0x55
+	codecDagPB = 0x70
+)
+
+var errBadBlock = errors.New("invalid dag-pb or unixfs block")
+
+// parseCID returns the codec and multihash of a CID in its binary form.
+func parseCID(b []byte) (codec uint64, mh string, err error) {
+	if len(b) == 34 && b[0] == 0x12 && b[1] == 0x20 {
+		return codecDagPB, string(b), nil
+	}
+	version, n := binary.Uvarint(b)
+	if n <= 0 || version != 1 {
+		return 0, "", errors.New("invalid cid")
+	}
+	codec, m := binary.Uvarint(b[n:])
+	if m <= 0 {
+		return 0, "", errors.New("invalid cid")
+	}
+	return codec, string(b[n+m:]), nil
+}
+
+// decodeCID parses a CIDv0 or a base32 CIDv1.
+func decodeCID(s string) (codec uint64, mh string, err error) {
+	switch {
+	case strings.HasPrefix(s, "Qm"):
+		b, err := unbase58(s)
+		if err != nil {
+			return 0, "", err
+		}
+		return parseCID(b)
+	case strings.HasPrefix(s, "b"):
+		b, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(s[1:]))
+		if err != nil {
+			return 0, "", err
+		}
+		return parseCID(b)
+	}
+	return 0, "", errors.New("unsupported cid " + s)
+}
+
+func unbase58(s string) ([]byte, error) {
+	x := new(big.Int)
+	radix := big.NewInt(58)
+	for _, c := range s {
+		i := strings.IndexRune(base58Alphabet, c)
+		if i == -1 {
+			return nil, errors.New("invalid base58")
+		}
+		x.Mul(x, radix)
+		x.Add(x, big.NewInt(int64(i)))
+	}
+	return x.Bytes(), nil
+}
+
+// pbFields splits a protobuf message into its fields. Varint fields are
+// returned as their value and length-delimited fields as their contents.
+func pbFields(b []byte, f func(field int, value uint64, data []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errBadBlock
+		}
+		b = b[n:]
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return errBadBlock
+			}
+			b = b[n:]
+			if err := f(int(tag>>3), v, nil); err != nil {
+				return err
+			}
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errBadBlock
+			}
+			if err := f(int(tag>>3), 0, b[n:n+int(l)]); err != nil {
+				return err
+			}
+			b = b[n+int(l):]
+		default:
+			return errBadBlock
+		}
+	}
+	return nil
+}
+
+// buildNode turns a DAG made of blocks added with block/put into a node.
+func (d *Daemon) buildNode(codec uint64, mh string) (*node, error) {
+	block, ok := d.raw[mh]
+	if !ok || block.codec != codec {
+		return nil, errNotExist
+	}
+	if codec == codecRaw {
+		return &node{data: append([]byte(nil), block.data...)}, nil
+	}
+
+	type link struct {
+		name string
+		cid  []byte
+	}
+	var links []link
+	var data []byte
+	err := pbFields(block.data, func(field int, _ uint64, b []byte) error {
+		switch field {
+		case 1:
+			data = b
+		case 2:
+			var l link
+			err := pbFields(b, func(field int, _ uint64, b []byte) error {
+				switch field {
+				case 1:
+					l.cid = b
+				case 2:
+					l.name = string(b)
+				}
+				return nil
+			})
+			links = append(links, l)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var unixfsType uint64
+	var content []byte
+	err = pbFields(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			unixfsType = v
+		case 2:
+			content = b
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	n := &node{data: append([]byte(nil), content...), symlink: unixfsType == 4}
+	if unixfsType == 1 {
+		n.links = make(map[string]*node)
+	}
+	for _, l := range links {
+		codec, mh, err := parseCID(l.cid)
+		if err != nil {
+			return nil, err
+		}
+		child, err := d.buildNode(codec, mh)
+		if err != nil {
+			return nil, err
+		}
+		if n.isDir() {
+			n.links[l.name] = child
+		} else {
+			n.data = append(n.data, child.data...)
+		}
+	}
+	return n, nil
+}
+
+// encodeNode encodes the UnixFS data of a node without its links.
+func encodeNode(n *node) []byte {
+	var data []byte
+	switch {
+	case n.isDir():
+		data = pbVarint(data, 1, 1)
+	case n.symlink:
+		data = pbVarint(data, 1, 4)
+		data = pbBytes(data, 2, n.data)
+	default:
+		data = pbVarint(data, 1, 2)
+		data = pbBytes(data, 2, n.data)
+		data = pbVarint(data, 3, uint64(len(n.data)))
+	}
+	return pbBytes(nil, 1, data)
+}
+
+func pbVarint(b []byte, field int, v uint64) []byte {
+	b = appendUvarint(b, uint64(field)<<3)
+	return appendUvarint(b, v)
+}
+
+func pbBytes(b []byte, field int, v []byte) []byte {
+	b = appendUvarint(b, uint64(field)<<3|2)
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
@@ -0,0 +1,173 @@
+package ipfstest
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+)
+
+// node is a file, directory or symlink. Directories have a non-nil links
+// map. The data of a symlink is its target.
+type node struct {
+	data    []byte
+	links   map[string]*node
+	symlink bool
+
+	// UnixFS 1.5 metadata
+	mode       uint32 // permission bits, or 0 if not set
+	mtime      int64
+	mtimeNsecs int64
+}
+
+// fileMode returns the mode as the daemon reports it.
+func (n *node) fileMode() os.FileMode {
+	if n.mode == 0 {
+		return 0
+	}
+	m := os.FileMode(n.mode & 0777)
+	if n.mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if n.mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if n.mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	if n.isDir() {
+		m |= os.ModeDir
+	}
+	return m
+}
+
+func newDir() *node {
+	return &node{links: make(map[string]*node)}
+}
+
+func (n *node) isDir() bool {
+	return n.links != nil
+}
+
+func (n *node) typeName() string {
+	if n.isDir() {
+		return "directory"
+	}
+	if n.symlink {
+		return "symlink"
+	}
+	return "file"
+}
+
+func (n *node) size() uint64 {
+	if n.isDir() {
+		return 0
+	}
+	return uint64(len(n.data))
+}
+
+func (n *node) cumulativeSize() uint64 {
+	size := uint64(len(n.data))
+	for _, c := range n.links {
+		size += c.cumulativeSize()
+	}
+	return size
+}
+
+func (n *node) names() []string {
+	names := make([]string, 0, len(n.links))
+	for name := range n.links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// clone returns a deep copy of n.
+func (n *node) clone() *node {
+	c := n.copyNode()
+	if n.isDir() {
+		c.links = make(map[string]*node, len(n.links))
+		for name, child := range n.links {
+			c.links[name] = child.clone()
+		}
+	}
+	return c
+}
+
+// copyNode returns a copy of n without its links.
+func (n *node) copyNode() *node {
+	c := *n
+	c.data = append([]byte(nil), n.data...)
+	c.links = nil
+	return &c
+}
+
+// walk follows the slash-separated path from n. It returns nil if any
+// component does not exist.
+func (n *node) walk(path string) *node {
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		if !n.isDir() {
+			return nil
+		}
+		n = n.links[name]
+		if n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// put adds an immutable copy of n and all of its children to the block store
+// and returns its hash.
+func (d *Daemon) put(n *node) string {
+	h := sha256.New()
+	c := n.copyNode()
+	fmt.Fprintf(h, "%o %d.%d\x00", n.mode, n.mtime, n.mtimeNsecs)
+	if n.isDir() {
+		c.links = make(map[string]*node, len(n.links))
+		h.Write([]byte("directory\x00"))
+		for _, name := range n.names() {
+			hash := d.put(n.links[name])
+			c.links[name] = d.blocks[hash]
+			h.Write([]byte(name + "\x00" + hash + "\x00"))
+		}
+	} else {
+		h.Write([]byte(n.typeName() + "\x00"))
+		h.Write(n.data)
+	}
+
+	hash := base58(append([]byte{0x12, 0x20}, h.Sum(nil)...))
+	if _, ok := d.blocks[hash]; !ok {
+		d.blocks[hash] = c
+	}
+	return hash
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58(b []byte) string {
+	var out []byte
+	x := new(big.Int).SetBytes(b)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	for x.Sign() > 0 {
+		x.DivMod(x, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
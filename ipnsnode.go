@@ -1,8 +1,10 @@
 package main
 
 import (
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 )
 
 type IPNSNode struct {
@@ -18,3 +20,7 @@ func (n *IPNSNode) GetAttr(out *fuse.Attr, file nodefs.File, ctx *fuse.Context)
 	out.Mode = fuse.S_IFLNK | 0444
 	return fuse.OK
 }
+
+func (n *IPNSNode) Rename(oldName string, newParent nodefs.Node, newName string, ctx *fuse.Context) fuse.Status {
+	return fuse.Status(syscall.EXDEV)
+}
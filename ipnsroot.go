@@ -1,22 +1,24 @@
 package main
 
 import (
-	"context"
-	"log"
+	"syscall"
 
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 )
 
 type IPNSRootNode struct {
 	nodefs.Node
+	Backend Backend
 }
 
 func (n *IPNSRootNode) Lookup(out *fuse.Attr, name string, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
-	dest, err := Resolve(context.TODO(), name)
+	c, cancel := opContext(ctx, *flagTimeout)
+	defer cancel()
+
+	dest, err := n.Backend.Resolve(c, name)
 	if err != nil {
-		log.Println("Lookup", "/ipns/"+name, err)
-		return nil, fuse.EIO
+		return nil, errorStatus(c, err, "Lookup", "/ipns/"+name)
 	}
 	if dest == "" {
 		return nil, fuse.ENOENT
@@ -45,3 +47,9 @@ func (n *IPNSRootNode) GetXAttr(attribute string, ctx *fuse.Context) (data []byt
 func (n *IPNSRootNode) ListXAttr(ctx *fuse.Context) (attrs []string, code fuse.Status) {
 	return nil, fuse.OK
 }
+
+// Rename returns EXDEV for names in /ipns, so that mv copies the target of
+// the link instead of giving up.
+func (n *IPNSRootNode) Rename(oldName string, newParent nodefs.Node, newName string, ctx *fuse.Context) fuse.Status {
+	return fuse.Status(syscall.EXDEV)
+}
@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"log"
 	"os"
 	"path/filepath"
+	"time"
 
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 )
 
 var flagMountPoint = flag.String("mount", filepath.Join(os.Getenv("HOME"), "ipfs-fuse"), "mount point")
+var flagAPI = flag.String("api", os.Getenv("IPFS_API"), "IPFS API address as a multiaddr or URL (default: $IPFS_PATH/api)")
+var flagAPIAuth = flag.String("api-auth", os.Getenv("IPFS_API_AUTH"), "IPFS API authorization as basic:user:password or bearer:token")
+var flagAPICA = flag.String("api-ca", "", "PEM file of certificate authorities to trust for an https IPFS API")
+var flagAPICert = flag.String("api-cert", "", "PEM file containing a client certificate for the IPFS API")
+var flagAPIKey = flag.String("api-key", "", "PEM file containing the private key for -api-cert")
 
 var ufsRoot *UnixFSRootNode
 var ipfsRoot *IPFSRootNode
@@ -18,20 +26,81 @@ var ipnsRoot *IPNSRootNode
 func main() {
 	flag.Parse()
 
-	ufsRoot = &UnixFSRootNode{UnixFSNode: UnixFSNode{Node: nodefs.NewDefaultNode(), Path: "/"}}
-	ipfsRoot = &IPFSRootNode{Node: nodefs.NewDefaultNode()}
-	ipnsRoot = &IPNSRootNode{Node: nodefs.NewDefaultNode()}
+	if err := defaultDAGOptions().check(); err != nil {
+		log.Fatalln(err)
+	}
+	if *flagLocalDAG && *flagSpoolDir == "" {
+		// Only shrinking truncates would use it.
+		log.Fatalln("-local-dag needs -spool-dir")
+	}
 
-	opts := nodefs.NewOptions()
-	conn := nodefs.NewFileSystemConnector(ufsRoot, opts)
-	server, err := fuse.NewServer(conn.RawFS(), *flagMountPoint, &fuse.MountOptions{
-		AllowOther:           true,
-		FsName:               "ipfs",
-		IgnoreSecurityLabels: true,
+	api := *flagAPI
+	if api == "" {
+		api = defaultAPI()
+	}
+	sh, err := newShell(api, APIOptions{
+		Auth:     *flagAPIAuth,
+		CAFile:   *flagAPICA,
+		CertFile: *flagAPICert,
+		KeyFile:  *flagAPIKey,
 	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	backend := NewHTTPBackend(sh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	_, err = backend.Stat(ctx, "/")
+	cancel()
+	if err != nil {
+		log.Fatalln("Cannot reach IPFS API at", api+":", err)
+	}
+
+	if *flagCacheDir != "" {
+		blockCache, err = OpenBlockCache(*flagCacheDir, *flagCacheSize)
+		if err != nil {
+			log.Fatalln("Cannot open cache directory:", err)
+		}
+	}
+
+	if *flagSpoolDir != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), *flagIOTimeout)
+		err = recoverSpool(ctx, backend, *flagSpoolDir)
+		cancel()
+		if err != nil {
+			log.Fatalln("Cannot recover spool directory:", err)
+		}
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), *flagTimeout)
+	err = cleanUnlinked(ctx, backend)
+	cancel()
+	if err != nil {
+		log.Fatalln("Cannot remove unlinked files:", err)
+	}
+
+	server, err := mount(backend, *flagMountPoint)
 	if err != nil {
 		panic(err)
 	}
 
 	server.Serve()
 }
+
+func mount(backend Backend, mountPoint string) (*fuse.Server, error) {
+	ufsRoot = &UnixFSRootNode{UnixFSNode: UnixFSNode{Node: nodefs.NewDefaultNode(), Backend: backend}}
+	ipfsRoot = &IPFSRootNode{Node: nodefs.NewDefaultNode(), Backend: backend}
+	ipnsRoot = &IPNSRootNode{Node: nodefs.NewDefaultNode(), Backend: backend}
+
+	opts := nodefs.NewOptions()
+	opts.EntryTimeout = *flagEntryTimeout
+	opts.AttrTimeout = *flagAttrTimeout
+	opts.NegativeTimeout = *flagNegativeTimeout
+
+	fsConn = nodefs.NewFileSystemConnector(ufsRoot, opts)
+	return fuse.NewServer(&rawFS{fsConn.RawFS()}, mountPoint, &fuse.MountOptions{
+		AllowOther:           true,
+		FsName:               "ipfs",
+		IgnoreSecurityLabels: true,
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// unixMode converts the mode reported by the daemon to the permission bits
+// of st_mode.
+func unixMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	return mode
+}
+
+// metadataToAttr sets the mode and times of out from the UnixFS 1.5
+// metadata in stat. Nodes without metadata get perm and the mtime fallback.
+func metadataToAttr(out *fuse.Attr, stat *UnixFSStat, perm uint32, fallback time.Time) {
+	mtime := fallback
+	if stat.Mtime != 0 {
+		mtime = time.Unix(stat.Mtime, stat.MtimeNsecs)
+	}
+	out.Mtime, out.Mtimensec = uint64(mtime.Unix()), uint32(mtime.Nanosecond())
+	out.Ctime, out.Ctimensec = out.Mtime, out.Mtimensec
+
+	if stat.Mode != 0 {
+		perm = unixMode(stat.Mode)
+	}
+	out.Mode = out.Mode&syscall.S_IFMT | perm
+}
+
+// readOnlyMetadataToAttr is metadataToAttr for /ipfs, where the permissions
+// in out are the default and nothing can be written. Content there never
+// changes, so nodes without metadata get the oldest time that is not zero.
+func readOnlyMetadataToAttr(out *fuse.Attr, stat *UnixFSStat) {
+	metadataToAttr(out, stat, out.Mode&07777, time.Unix(1, 0))
+	out.Mode &^= 0222
+}
+
+// seenAt keeps, for each MFS path that was looked at without an mtime, the
+// hash it had and when that hash was first seen there. Entries follow
+// renames and go away with what they describe; beyond maxSeen, arbitrary
+// entries are dropped, and those nodes look changed when next seen.
+var seenAt = struct {
+	sync.Mutex
+	byPath map[string]seenHash
+}{byPath: make(map[string]seenHash)}
+
+const maxSeen = 1 << 16
+
+type seenHash struct {
+	hash string
+	at   time.Time
+}
+
+// seen returns the mtime to report for n if stat has none: the time its
+// content was first seen at its path by this process. Nodes changed by
+// other clients of the daemon then still look newer than before.
+func (n *UnixFSNode) seen(stat *UnixFSStat) time.Time {
+	if stat.Mtime != 0 {
+		return time.Time{}
+	}
+
+	p := n.Path()
+	seenAt.Lock()
+	defer seenAt.Unlock()
+
+	s, ok := seenAt.byPath[p]
+	if !ok && len(seenAt.byPath) >= maxSeen {
+		for other := range seenAt.byPath {
+			delete(seenAt.byPath, other)
+			break
+		}
+	}
+	if !ok || s.hash != stat.Hash {
+		s = seenHash{hash: stat.Hash, at: time.Now()}
+		seenAt.byPath[p] = s
+	}
+	return s.at
+}
+
+// moveSeen moves the times recorded by seen for oldPath and everything
+// below it to newPath, replacing those there, or forgets them if newPath is
+// empty.
+func moveSeen(oldPath, newPath string) {
+	seenAt.Lock()
+	defer seenAt.Unlock()
+
+	moved := make(map[string]seenHash)
+	for p, s := range seenAt.byPath {
+		if isBelow(p, oldPath) {
+			moved[newPath+strings.TrimPrefix(p, oldPath)] = s
+			delete(seenAt.byPath, p)
+		} else if newPath != "" && isBelow(p, newPath) {
+			delete(seenAt.byPath, p)
+		}
+	}
+	if newPath == "" {
+		return
+	}
+	for p, s := range moved {
+		seenAt.byPath[p] = s
+	}
+}
+
+// modify records that the content of n was changed through the mount. The
+// time is reported by GetAttr and stored in MFS by stampModified once the
+// change has been sent.
+func (n *UnixFSNode) modify() {
+	n.mu.Lock()
+	n.modified = time.Now()
+	n.mu.Unlock()
+}
+
+// stampModified sets the mtime of n in MFS to the time of the last change
+// recorded by modify, if it has not been stored yet. The data has already
+// been written by then, so a failure is only logged, and the time is kept
+// to be stored with the next change.
+func (n *UnixFSNode) stampModified(ctx context.Context) {
+	n.mu.Lock()
+	mtime := n.modified
+	n.modified = time.Time{}
+	n.mu.Unlock()
+
+	if mtime.IsZero() {
+		return
+	}
+	if err := n.Backend.Touch(ctx, n.Path(), mtime); err != nil {
+		log.Println("Touch", n.Path()+":", err)
+		n.mu.Lock()
+		if n.modified.IsZero() {
+			n.modified = mtime
+		}
+		n.mu.Unlock()
+		return
+	}
+	n.setStat(nil)
+}
+
+// modifiedToAttr sets the times of out to those of changes that have not
+// been stored yet.
+func (n *UnixFSNode) modifiedToAttr(out *fuse.Attr) {
+	n.mu.Lock()
+	mtime := n.modified
+	n.mu.Unlock()
+
+	if !mtime.IsZero() {
+		out.Mtime, out.Mtimensec = uint64(mtime.Unix()), uint32(mtime.Nanosecond())
+		out.Ctime, out.Ctimensec = out.Mtime, out.Mtimensec
+	}
+}
+
+// commitMetadata sends the writes to n that are waiting, so that the
+// metadata is set on the current content.
+func (n *UnixFSNode) commitMetadata(c *fuse.Context) fuse.Status {
+	ctx, cancel := opContext(c, *flagIOTimeout)
+	defer cancel()
+
+	n.flushWrites(ctx)
+	if err := n.commitSpool(ctx); err != nil {
+		return errorStatus(ctx, err, "Write", n.Path())
+	}
+	return fuse.OK
+}
@@ -1,75 +1,165 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"log"
+	"flag"
+	"io"
+	"sync"
+	"time"
 
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 )
 
+var flagSnapshotReads = flag.Bool("snapshot-reads", false, "serve MFS files opened read-only from the version they had when they were opened")
+
 type UnixFSFile struct {
 	nodefs.File
 	Node *UnixFSNode
+
+	ra readahead
+
+	wmu    sync.Mutex
+	wbuf   []byte // buffered writes, starting at woff
+	woff   int64
+	wtimer *time.Timer
+	werr   error // from a write that has not been reported yet
+
+	spool *spoolFile // if the file was opened for writing with -spool-dir
 }
 
 func (f *UnixFSFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
-	resp, err := ipfs.Request("files/read", f.Node.Path).Option("offset", off).Option("count", len(dest)).Option("flush", false).Send(context.TODO())
-	if err == nil && resp.Error != nil {
-		err = resp.Error
-	}
-	if err != nil {
-		log.Println("Read", f.Node.Path, err)
-		return nil, fuse.EIO
-	}
+	return f.read(nil, dest, off)
+}
+
+func (f *UnixFSFile) read(ctx *fuse.Context, dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	c, cancel := opContext(ctx, *flagIOTimeout)
+	defer cancel()
 
-	n, err := readFull(resp.Output, dest)
-	if e := resp.Close(); err == nil {
-		err = e
+	if s := f.Node.filledSpool(); s != nil {
+		n, err := s.file.ReadAt(dest, off)
+		if err == io.EOF {
+			err = nil
+		}
+		if err != nil {
+			return nil, errorStatus(c, err, "Read", f.Node.Path())
+		}
+		return fuse.ReadResultData(dest[:n]), fuse.OK
 	}
+
+	f.Node.flushWrites(c)
+
+	n, err := f.ra.Read(c, dest, off, func(ctx context.Context, offset, count int64) (io.ReadCloser, error) {
+		return f.Node.Backend.Read(ctx, f.Node.Path(), offset, count)
+	})
 	result := fuse.ReadResultData(dest[:n])
 	if err != nil {
-		log.Println("Read", f.Node.Path, err)
-		return result, fuse.EIO
+		return result, errorStatus(c, err, "Read", f.Node.Path())
 	}
 
 	return result, fuse.OK
 }
 
 func (f *UnixFSFile) Write(data []byte, off int64) (uint32, fuse.Status) {
-	resp, err := attachFile(ipfs.Request("files/write", f.Node.Path), data).Option("flush", false).Option("offset", off).Option("raw-leaves", true).Send(context.TODO())
-	if err == nil {
-		err = resp.Close()
-	}
-	if err == nil && resp.Error != nil {
-		err = resp.Error
-	}
+	return f.write(nil, data, off)
+}
+
+func (f *UnixFSFile) write(ctx *fuse.Context, data []byte, off int64) (uint32, fuse.Status) {
+	c, cancel := opContext(ctx, *flagIOTimeout)
+	defer cancel()
+
+	// Data that was already sent to any handle may be out of date now.
+	f.Node.resetReadahead()
 
+	var err error
+	if f.spool != nil {
+		err = f.Node.writeSpool(c, f.spool, data, off)
+	} else if *flagWriteBuffer > 0 {
+		err = f.bufferWrite(c, data, off)
+	} else {
+		err = f.Node.Backend.Write(c, f.Node.Path(), bytes.NewReader(data), WriteOptions{Offset: off, DAG: f.Node.dagOptions()})
+	}
 	if err != nil {
-		log.Println("Write", f.Node.Path, err)
-		return 0, fuse.EIO
+		return 0, errorStatus(c, err, "Write", f.Node.Path())
 	}
+	// The kernel keeps track of the size of files it writes to, so only
+	// our own cache needs to be cleared until the file is flushed.
+	f.Node.setStat(nil)
+	f.Node.modify()
 
 	return uint32(len(data)), fuse.OK
 }
 
+// resetReadahead drops the data that was requested ahead for every open
+// handle of n, after the file changes.
+func (n *UnixFSNode) resetReadahead() {
+	n.mu.Lock()
+	files := make([]*UnixFSFile, 0, len(n.files))
+	for f := range n.files {
+		files = append(files, f)
+	}
+	n.mu.Unlock()
+
+	for _, f := range files {
+		f.ra.Reset()
+	}
+}
+
 func (f *UnixFSFile) Flush() fuse.Status {
-	resp, err := ipfs.Request("files/flush", f.Node.Path).Send(context.TODO())
-	if err == nil {
-		err = resp.Close()
+	if f.spool != nil {
+		// The file is committed when the last handle is released.
+		return fuse.OK
 	}
-	if err == nil && resp.Error != nil {
-		err = resp.Error
+
+	c, cancel := opContext(nil, *flagIOTimeout)
+	defer cancel()
+
+	if err := f.flushBuffer(c); err != nil {
+		return errorStatus(c, err, "Write", f.Node.Path())
 	}
+	f.Node.stampModified(c)
 
+	err := f.Node.Backend.Flush(c, f.Node.Path())
 	if err != nil {
-		log.Println("Flush", f.Node.Path, err)
-		return fuse.EIO
+		return errorStatus(c, err, "Flush", f.Node.Path())
 	}
+	f.Node.invalidate()
 	return fuse.OK
 }
 
+func (f *UnixFSFile) Release() {
+	c, cancel := opContext(nil, *flagIOTimeout)
+	defer cancel()
+
+	// There is nobody left to report an error to.
+	if err := f.flushBuffer(c); err != nil {
+		errorStatus(c, err, "Write", f.Node.Path())
+	}
+	f.wbuf = nil
+	if f.spool == nil {
+		f.Node.stampModified(c)
+	}
+	if f.spool != nil {
+		if err := f.Node.releaseSpool(c); err != nil {
+			errorStatus(c, err, "Write", f.Node.Path())
+		}
+		f.spool = nil
+	}
+	f.Node.releaseFile(c, f)
+	f.ra.Reset()
+}
+
 func (f *UnixFSFile) Fsync(flags int) fuse.Status {
+	if f.spool != nil {
+		c, cancel := opContext(nil, *flagIOTimeout)
+		defer cancel()
+
+		if err := f.Node.commitSpool(c); err != nil {
+			return errorStatus(c, err, "Fsync", f.Node.Path())
+		}
+		return fuse.OK
+	}
 	return f.Flush()
 }
 
@@ -80,3 +170,34 @@ func (f *UnixFSFile) GetAttr(out *fuse.Attr) fuse.Status {
 func (f *UnixFSFile) Truncate(size uint64) fuse.Status {
 	return f.Node.Truncate(f, size, &fuse.Context{})
 }
+
+// openSnapshot opens the version of n that is in MFS now, including the
+// writes of handles that are still open, as a read-only file.
+func (n *UnixFSNode) openSnapshot(ctx *fuse.Context) (nodefs.File, fuse.Status) {
+	c, cancel := opContext(ctx, *flagIOTimeout)
+	defer cancel()
+
+	n.flushWrites(c)
+	if err := n.commitSpool(c); err != nil {
+		return nil, errorStatus(c, err, "Open", n.Path())
+	}
+
+	stat, err := n.Backend.Stat(c, n.Path())
+	if err != nil {
+		return nil, errorStatus(c, err, "Open", n.Path())
+	}
+	if stat == nil {
+		return nil, fuse.ENOENT
+	}
+	if stat.Type == "directory" {
+		return nil, fuse.EISDIR
+	}
+	n.setStat(stat)
+
+	// Pages in the kernel's cache may be from another version.
+	return &nodefs.WithFlags{
+		Description: n.Path() + " (" + stat.Hash + ")",
+		File:        &ReadOnlyFile{File: nodefs.NewDefaultFile(), Backend: n.Backend, Hash: stat.Hash},
+		FuseFlags:   fuse.FOPEN_DIRECT_IO,
+	}, fuse.OK
+}
@@ -2,59 +2,123 @@ package main
 
 import (
 	"context"
-	"io/ioutil"
+	"io"
 	"log"
 	"path"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 )
 
 type UnixFSNode struct {
 	nodefs.Node
-	Path string
+	Backend Backend
+
+	// parent and name are the position of n in MFS, and change when n is
+	// renamed. The root has no parent. Paths are computed from them when
+	// they are needed, so that renaming a directory does not leave its
+	// descendants pointing at the old location.
+	parent *UnixFSNode
+	name   string
+
+	mu       sync.Mutex
+	cached   *UnixFSStat
+	cachedAt time.Time
+	files    map[*UnixFSFile]bool // open handles
+	unlinked bool                 // removed from MFS while open; see keepUnlinked
+	spool    *spoolFile
+	modified time.Time // of changes not stored in MFS yet; see modify
+
+	linkHash, linkTarget string // the last symlink target read
+
+	spoolMu sync.Mutex
 }
 
-func (n *UnixFSNode) Lookup(out *fuse.Attr, name string, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
-	childPath := path.Join(n.Path, name)
-	stat, err := FastStat(context.TODO(), childPath)
-	if err != nil {
-		log.Println("Lookup", childPath, err)
-		return nil, fuse.EIO
+// treeMu guards the parent and name of every UnixFSNode.
+var treeMu sync.RWMutex
+
+func (n *UnixFSNode) newChild(name string) *UnixFSNode {
+	return &UnixFSNode{
+		Node:    nodefs.NewDefaultNode(),
+		Backend: n.Backend,
+		parent:  n,
+		name:    name,
 	}
-	if stat == nil {
-		n.Inode().RmChild(name)
-		return nil, fuse.ENOENT
+}
+
+// Path returns the current MFS path of n.
+func (n *UnixFSNode) Path() string {
+	treeMu.RLock()
+	defer treeMu.RUnlock()
+
+	return n.pathLocked()
+}
+
+func (n *UnixFSNode) pathLocked() string {
+	if n.parent == nil {
+		return "/"
 	}
+	return path.Join(n.parent.pathLocked(), n.name)
+}
 
-	out.Mtime = 1
-	out.Ctime = 1
+func statToAttr(out *fuse.Attr, stat *UnixFSStat, fallback time.Time) {
 	out.Size = stat.Size
 	out.Blocks = out.Size
 	out.Blksize = 1
-	out.Mode = 0644
-	if stat.Type == "directory" {
-		out.Mode |= fuse.S_IFDIR | 0111
-	} else {
-		out.Mode |= fuse.S_IFREG
+	switch stat.Type {
+	case "directory":
+		out.Mode = fuse.S_IFDIR
+		metadataToAttr(out, stat, 0755, fallback)
+	case "symlink":
+		out.Mode = fuse.S_IFLNK
+		metadataToAttr(out, stat, 0777, fallback)
+	default:
+		out.Mode = fuse.S_IFREG
+		metadataToAttr(out, stat, 0644, fallback)
+	}
+}
+
+func (n *UnixFSNode) Lookup(out *fuse.Attr, name string, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	c, cancel := opContext(ctx, *flagTimeout)
+	defer cancel()
+
+	if n.isHidden(name) {
+		return nil, fuse.ENOENT
+	}
+
+	// FastStat lists directories instead of stat-ing them, which does
+	// not give their hash, mode or mtime; only files/stat has those.
+	childPath := path.Join(n.Path(), name)
+	stat, err := n.Backend.Stat(c, childPath)
+	if err != nil {
+		return nil, errorStatus(c, err, "Lookup", childPath)
+	}
+	if stat == nil {
+		n.Inode().RmChild(name)
+		return nil, fuse.ENOENT
 	}
 
-	node := &UnixFSNode{
-		Node: nodefs.NewDefaultNode(),
-		Path: childPath,
+	node := n.newChild(name)
+	node.setStat(stat)
+	statToAttr(out, stat, node.seen(stat))
+	if err := node.linkAttr(c, out, stat); err != nil {
+		return nil, errorStatus(c, err, "Lookup", childPath)
 	}
 
 	return n.Inode().NewChild(name, out.IsDir(), node), fuse.OK
 }
 
 func (n *UnixFSNode) OpenDir(ctx *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
-	list, err := FastList(context.TODO(), n.Path+"/")
+	c, cancel := opContext(ctx, *flagTimeout)
+	defer cancel()
+
+	list, err := FastList(c, n.Backend, n.Path()+"/")
 	if err != nil {
-		log.Println("OpenDir", n.Path, err)
-		return nil, fuse.EIO
+		return nil, errorStatus(c, err, "OpenDir", n.Path())
 	}
 	if list == nil {
 		return nil, fuse.ENOENT
@@ -71,24 +135,30 @@ func (n *UnixFSNode) OpenDir(ctx *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
 
 	existing := n.Inode().Children()
 	for _, entry := range list.Entries {
+		if n.isHidden(entry.Name) {
+			continue
+		}
 		isDir := entry.Type == Directory
+
 		if e, ok := existing[entry.Name]; ok {
 			delete(existing, entry.Name)
 
 			if e.IsDir() == isDir {
+				if child, ok := e.Node().(*UnixFSNode); ok {
+					child.listed(entry)
+				}
 				continue
 			}
 
 			n.Inode().RmChild(entry.Name)
 		}
 
-		n.Inode().NewChild(entry.Name, isDir, &UnixFSNode{
-			Node: nodefs.NewDefaultNode(),
-			Path: path.Join(n.Path, entry.Name),
-		})
+		child := n.newChild(entry.Name)
+		child.listed(entry)
+		n.Inode().NewChild(entry.Name, isDir, child)
 	}
 
-	if n.Path == "/" {
+	if n.Path() == "/" {
 		delete(existing, "ipfs")
 		delete(existing, "ipns")
 	}
@@ -100,24 +170,50 @@ func (n *UnixFSNode) OpenDir(ctx *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
 	return n.Node.OpenDir(ctx)
 }
 
+// listed updates the cached attributes of n from its directory listing.
+// Only entries that FastList stat-ed have the mode and mtime; otherwise the
+// cached attributes are kept unless the hash shows they are out of date.
+func (n *UnixFSNode) listed(entry UnixFSDirEntry) {
+	if entry.stat != nil {
+		n.setStat(entry.stat)
+		return
+	}
+
+	n.mu.Lock()
+	if n.cached != nil && entry.Hash != "" && n.cached.Hash != entry.Hash {
+		n.cached = nil
+	}
+	n.mu.Unlock()
+}
+
 func (n *UnixFSNode) GetAttr(out *fuse.Attr, file nodefs.File, ctx *fuse.Context) fuse.Status {
-	stat, err := FastStat(context.TODO(), n.Path)
+	if answerProbe(ctx, n, file) {
+		return fuse.OK
+	}
+
+	c, cancel := opContext(ctx, *flagTimeout)
+	defer cancel()
+
+	n.flushWrites(c)
+
+	stat, err := n.stat(c)
 	if err != nil {
-		log.Println("GetAttr", n.Path, err)
-		return fuse.EIO
+		return errorStatus(c, err, "GetAttr", n.Path())
 	}
 	if stat == nil {
 		return fuse.ENOENT
 	}
 
-	out.Mtime = 1
-	out.Ctime = 1
-	out.Size = stat.Size
-	out.Mode = 0644
-	if stat.Type == "directory" {
-		out.Mode |= fuse.S_IFDIR | 0111
-	} else {
-		out.Mode |= fuse.S_IFREG
+	statToAttr(out, stat, n.seen(stat))
+	n.modifiedToAttr(out)
+	if err := n.linkAttr(c, out, stat); err != nil {
+		return errorStatus(c, err, "GetAttr", n.Path())
+	}
+	if s := n.filledSpool(); s != nil {
+		if fi, err := s.file.Stat(); err == nil {
+			out.Size = uint64(fi.Size())
+			out.Blocks = out.Size
+		}
 	}
 
 	return fuse.OK
@@ -126,10 +222,12 @@ func (n *UnixFSNode) GetAttr(out *fuse.Attr, file nodefs.File, ctx *fuse.Context
 func (n *UnixFSNode) GetXAttr(attribute string, ctx *fuse.Context) ([]byte, fuse.Status) {
 	switch attribute {
 	case "user.ipfs-hash":
-		stat, err := Stat(context.TODO(), n.Path)
+		c, cancel := opContext(ctx, *flagTimeout)
+		defer cancel()
+
+		stat, err := n.Backend.Stat(c, n.Path())
 		if err != nil {
-			log.Println("GetXAttr", n.Path, err)
-			return nil, fuse.EIO
+			return nil, errorStatus(c, err, "GetXAttr", n.Path())
 		}
 		if stat == nil {
 			return nil, fuse.ENOENT
@@ -137,122 +235,296 @@ func (n *UnixFSNode) GetXAttr(attribute string, ctx *fuse.Context) ([]byte, fuse
 
 		return []byte(stat.Hash), fuse.OK
 	default:
+		if isDAGXAttr(attribute) {
+			return []byte(n.dagOptions().get(attribute)), fuse.OK
+		}
 		return nil, fuse.ENOATTR
 	}
 }
+
 func (n *UnixFSNode) RemoveXAttr(attr string, ctx *fuse.Context) fuse.Status {
-	return fuse.EPERM
+	if !isDAGXAttr(attr) {
+		return fuse.EPERM
+	}
+	if !removeOverride(n.Path(), attr) {
+		return fuse.ENOATTR
+	}
+	return fuse.OK
 }
+
 func (n *UnixFSNode) SetXAttr(attr string, data []byte, flags int, ctx *fuse.Context) fuse.Status {
-	return fuse.EPERM
+	if !isDAGXAttr(attr) {
+		return fuse.EPERM
+	}
+	if !n.Inode().IsDir() {
+		// Overrides apply to everything created in a directory.
+		return fuse.EPERM
+	}
+	value := string(data)
+	opts := n.dagOptions()
+	err := opts.set(attr, value)
+	if err == nil {
+		err = opts.check()
+	}
+	if err != nil {
+		log.Println("SetXAttr", n.Path()+":", err)
+		return fuse.EINVAL
+	}
+
+	setOverride(n.Path(), attr, value)
+	return fuse.OK
 }
+
 func (n *UnixFSNode) ListXAttr(ctx *fuse.Context) ([]string, fuse.Status) {
-	return []string{"user.ipfs-hash"}, fuse.OK
+	return append([]string{"user.ipfs-hash"}, dagXAttrs...), fuse.OK
 }
 
 func (n *UnixFSNode) Mkdir(name string, mode uint32, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
-	dirName := path.Join(n.Path, name)
-	resp, err := ipfs.Request("files/mkdir", dirName).Send(context.TODO())
-	if err != nil {
-		log.Println("Mkdir", dirName, err)
-		return nil, fuse.EIO
-	}
-	if err = resp.Close(); err != nil {
-		log.Println("Mkdir", dirName, err)
-		return nil, fuse.EIO
-	}
-	if resp.Error != nil {
-		switch resp.Error.Message {
-		case "file does not exist":
-			return nil, fuse.ENOENT
-		case "file already exists":
-			return nil, fuse.Status(syscall.EEXIST)
-		default:
-			log.Println("Mkdir", dirName, resp.Error)
-			return nil, fuse.EIO
-		}
+	c, cancel := opContext(ctx, *flagTimeout)
+	defer cancel()
+
+	dirName := path.Join(n.Path(), name)
+	if err := n.Backend.Mkdir(c, dirName, n.dagOptions()); err != nil {
+		return nil, errorStatus(c, err, "Mkdir", dirName)
 	}
+	n.invalidate()
+	n.chmodCreated(c, dirName, mode, 0755)
 
-	return n.Inode().NewChild(name, true, &UnixFSNode{
-		Node: nodefs.NewDefaultNode(),
-		Path: dirName,
-	}), fuse.OK
+	return n.Inode().NewChild(name, true, n.newChild(name)), fuse.OK
 }
 
 func (n *UnixFSNode) Unlink(name string, ctx *fuse.Context) fuse.Status {
-	childPath := path.Join(n.Path, name)
-	resp, err := ipfs.Request("files/rm", childPath).Send(context.TODO())
-	if err == nil {
-		err = resp.Close()
-	}
-	if err == nil && resp.Error != nil {
-		if strings.HasSuffix(resp.Error.Message, " is a directory, use -r to remove directories") {
-			return fuse.EISDIR
-		} else if resp.Error.Message == "file does not exist" {
-			n.Inode().RmChild(name)
-			return fuse.ENOENT
-		}
+	c, cancel := opContext(ctx, *flagTimeout)
+	defer cancel()
 
-		err = resp.Error
-	}
+	n.flushChild(name, ctx)
 
-	if err != nil {
-		log.Println("Unlink", childPath, err)
-		return fuse.EIO
+	childPath := path.Join(n.Path(), name)
+	if node := n.openChild(name); node != nil {
+		hidden, err := n.hide(c, childPath)
+		if err != nil {
+			if isNotExist(err) {
+				n.Inode().RmChild(name)
+			}
+			return errorStatus(c, err, "Unlink", childPath)
+		}
+		if !node.keepUnlinked(hidden) {
+			// The last handle was released in the meantime.
+			removeHidden(c, n.Backend, hidden)
+		} else {
+			updateSpoolPaths()
+		}
+	} else if err := n.Backend.Remove(c, childPath, false); err != nil {
+		if isNotExist(err) {
+			n.Inode().RmChild(name)
+		}
+		return errorStatus(c, err, "Unlink", childPath)
 	}
 
+	n.invalidate()
 	n.Inode().RmChild(name)
+	moveSeen(childPath, "")
 	return fuse.OK
 }
 func (n *UnixFSNode) Rmdir(name string, ctx *fuse.Context) fuse.Status {
-	childPath := path.Join(n.Path, name)
-	resp, err := ipfs.Request("files/rm", childPath).Option("recursive", true).Send(context.TODO())
-	if err == nil {
-		err = resp.Close()
-	}
-	if err == nil && resp.Error != nil {
-		if resp.Error.Message == "file does not exist" {
-			n.Inode().RmChild(name)
-			return fuse.ENOENT
-		}
+	c, cancel := opContext(ctx, *flagTimeout)
+	defer cancel()
 
-		err = resp.Error
-	}
+	childPath := path.Join(n.Path(), name)
 
+	// files/rm -r removes non-empty directories, so check first.
+	list, err := n.Backend.List(c, childPath+"/", false)
 	if err != nil {
-		log.Println("Rmdir", childPath, err)
-		return fuse.EIO
+		return errorStatus(c, err, "Rmdir", childPath)
+	}
+	if list == nil {
+		n.Inode().RmChild(name)
+		return fuse.ENOENT
+	}
+	if len(list.Entries) == 1 && list.Entries[0].Name == "" {
+		return fuse.ENOTDIR
+	}
+	if len(list.Entries) != 0 {
+		return fuse.Status(syscall.ENOTEMPTY)
 	}
 
+	if err := n.Backend.Remove(c, childPath, true); err != nil {
+		if isNotExist(err) {
+			n.Inode().RmChild(name)
+		}
+		return errorStatus(c, err, "Rmdir", childPath)
+	}
+
+	n.invalidate()
 	n.Inode().RmChild(name)
+	moveOverrides(childPath, "")
+	moveSeen(childPath, "")
 	return fuse.OK
 }
 
 func (n *UnixFSNode) Rename(oldName string, newParent nodefs.Node, newName string, ctx *fuse.Context) fuse.Status {
+	c, cancel := opContext(ctx, *flagTimeout)
+	defer cancel()
+
 	if root, ok := newParent.(*UnixFSRootNode); ok {
 		newParent = &root.UnixFSNode
 	}
-	if np, ok := newParent.(*UnixFSNode); ok {
-		oldPath := path.Join(n.Path, oldName)
-		newPath := path.Join(np.Path, newName)
+	np, ok := newParent.(*UnixFSNode)
+	if !ok {
+		// /ipns is in the same FUSE mount, but not in MFS.
+		return fuse.Status(syscall.EXDEV)
+	}
+	if child := n.Inode().GetChild(oldName); child != nil {
+		if _, ok := child.Node().(*UnixFSNode); !ok {
+			return fuse.Status(syscall.EXDEV)
+		}
+	}
+	if np.Path() == "/" && (newName == "ipfs" || newName == "ipns") || np.isHidden(newName) {
+		return fuse.Status(syscall.EBUSY)
+	}
+
+	oldPath := path.Join(n.Path(), oldName)
+	newPath := path.Join(np.Path(), newName)
+	if oldPath == newPath {
+		return fuse.OK
+	}
 
-		resp, err := ipfs.Request("files/mv", oldPath, newPath).Send(context.TODO())
-		if err == nil {
-			err = resp.Close()
+	n.flushChild(oldName, ctx)
+	if status := n.move(c, oldPath, np.Path(), newName, np.openChild(newName)); status != fuse.OK {
+		return status
+	}
+	moveOverrides(oldPath, newPath)
+	moveSeen(oldPath, newPath)
+
+	n.invalidate()
+	np.invalidate()
+	np.Inode().RmChild(newName)
+	if child := n.Inode().RmChild(oldName); child != nil {
+		np.Inode().AddChild(newName, child)
+		if node, ok := child.Node().(*UnixFSNode); ok {
+			treeMu.Lock()
+			node.parent, node.name = np, newName
+			treeMu.Unlock()
 		}
-		if err == nil && resp.Error != nil {
-			err = resp.Error
+	}
+	// The node, one of its descendants or the replaced target may have
+	// a spool file.
+	updateSpoolPaths()
+	return fuse.OK
+}
+
+// move renames oldPath to newName in dir, replacing the file or empty
+// directory that is there, if any. replaced is the node of the target if it
+// is open, and keeps working after the move.
+func (n *UnixFSNode) move(ctx context.Context, oldPath, dir, newName string, replaced *UnixFSNode) fuse.Status {
+	newPath := path.Join(dir, newName)
+
+	dst, err := n.Backend.Stat(ctx, newPath)
+	if err != nil {
+		return errorStatus(ctx, err, "Rename", oldPath, newPath)
+	}
+	if dst == nil {
+		if err := n.Backend.Move(ctx, oldPath, newPath); err != nil {
+			return errorStatus(ctx, err, "Rename", oldPath, newPath)
 		}
+		return fuse.OK
+	}
 
+	src, err := n.Backend.Stat(ctx, oldPath)
+	if err != nil {
+		return errorStatus(ctx, err, "Rename", oldPath, newPath)
+	}
+	if src == nil {
+		return fuse.ENOENT
+	}
+	switch {
+	case src.Type == "directory" && dst.Type != "directory":
+		return fuse.ENOTDIR
+	case src.Type != "directory" && dst.Type == "directory":
+		return fuse.Status(syscall.EISDIR)
+	case dst.Type == "directory":
+		// Only the number of entries matters, which a plain listing
+		// has without stat-ing each of them.
+		list, err := n.Backend.List(ctx, newPath+"/", false)
 		if err != nil {
-			log.Println("Rename", oldPath, newPath, err)
-			return fuse.EIO
+			return errorStatus(ctx, err, "Rename", oldPath, newPath)
 		}
+		if list != nil && len(list.Entries) != 0 {
+			return fuse.Status(syscall.ENOTEMPTY)
+		}
+	}
 
-		n.Inode().RmChild(oldName)
-		return fuse.OK
+	// files/mv will not replace anything and the daemon has no other
+	// operation that does, so the old target is moved out of the way first
+	// and put back if the move fails. Unlike rename(2), this is not atomic:
+	// other clients of MFS can see newPath missing in between, and if the
+	// daemon goes away at the wrong time the old target is left in
+	// unlinkedDir.
+	aside, err := n.hide(ctx, newPath)
+	if err != nil {
+		return errorStatus(ctx, err, "Rename", oldPath, newPath)
 	}
-	return fuse.EPERM
+	if err := n.Backend.Move(ctx, oldPath, newPath); err != nil {
+		if e := n.Backend.Move(ctx, aside, newPath); e != nil {
+			log.Println("Rename: cannot restore", newPath, "from", aside+":", e)
+		}
+		return errorStatus(ctx, err, "Rename", oldPath, newPath)
+	}
+	if replaced == nil || !replaced.keepUnlinked(aside) {
+		removeHidden(ctx, n.Backend, aside)
+	}
+	return fuse.OK
+}
+
+// Link makes name a copy of existing with files/cp. The copy shares its
+// blocks with the original, so it takes no time or space however big the
+// file is, but it is not the same file: writing to one of them does not
+// change the other, and both have a link count of 1.
+//
+// Files under /ipfs are in another go-fuse mount, so nodefs turns links
+// from there down before they get here; rawFS.Link handles them.
+func (n *UnixFSNode) Link(name string, existing nodefs.Node, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	e, ok := existing.(*UnixFSNode)
+	if !ok {
+		return nil, fuse.Status(syscall.EXDEV)
+	}
+
+	c, cancel := opContext(ctx, *flagTimeout)
+	defer cancel()
+
+	e.flushWrites(c)
+	if err := e.commitSpool(c); err != nil {
+		return nil, errorStatus(c, err, "Link", e.Path())
+	}
+
+	stat, status := n.copyFrom(c, e.Path(), name)
+	if status != fuse.OK {
+		return nil, status
+	}
+	node := n.newChild(name)
+	node.setStat(stat)
+	return n.Inode().NewChild(name, stat.Type == "directory", node), fuse.OK
+}
+
+// copyFrom copies src to name in n with files/cp and returns its attributes.
+func (n *UnixFSNode) copyFrom(c context.Context, src, name string) (*UnixFSStat, fuse.Status) {
+	if n.isHidden(name) {
+		return nil, fuse.Status(syscall.EEXIST)
+	}
+	childPath := path.Join(n.Path(), name)
+	if err := n.Backend.Copy(c, src, childPath); err != nil {
+		return nil, errorStatus(c, err, "Link", src, childPath)
+	}
+	n.invalidate()
+
+	stat, err := n.Backend.Stat(c, childPath)
+	if err != nil {
+		return nil, errorStatus(c, err, "Link", src, childPath)
+	}
+	if stat == nil {
+		return nil, fuse.ENOENT
+	}
+	return stat, fuse.OK
 }
 
 func (n *UnixFSNode) Create(name string, flags uint32, mode uint32, ctx *fuse.Context) (nodefs.File, *nodefs.Inode, fuse.Status) {
@@ -262,62 +534,105 @@ func (n *UnixFSNode) Create(name string, flags uint32, mode uint32, ctx *fuse.Co
 	}
 
 	node := inode.Node().(*UnixFSNode)
+	f, status := node.openFile(flags, ctx)
+	if status != fuse.OK {
+		return nil, inode, status
+	}
 	return &nodefs.WithFlags{
-		Description: node.Path,
-		File: &UnixFSFile{
-			File: nodefs.NewDefaultFile(),
-			Node: node,
-		},
-		OpenFlags: flags,
+		Description: node.Path(),
+		File:        f,
+		OpenFlags:   flags,
 	}, inode, fuse.OK
 }
 func (n *UnixFSNode) Open(flags uint32, ctx *fuse.Context) (nodefs.File, fuse.Status) {
+	if *flagSnapshotReads && flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+		return n.openSnapshot(ctx)
+	}
+
+	f, status := n.openFile(flags, ctx)
+	if status != fuse.OK {
+		return nil, status
+	}
 	return &nodefs.WithFlags{
-		Description: n.Path,
-		File: &UnixFSFile{
-			File: nodefs.NewDefaultFile(),
-			Node: n,
-		},
-		OpenFlags: flags,
+		Description: n.Path(),
+		File:        f,
+		OpenFlags:   flags,
 	}, fuse.OK
 }
 
+func (n *UnixFSNode) Read(file nodefs.File, dest []byte, off int64, ctx *fuse.Context) (fuse.ReadResult, fuse.Status) {
+	switch f := file.(type) {
+	case *UnixFSFile:
+		return f.read(ctx, dest, off)
+	case *ReadOnlyFile:
+		return f.read(ctx, dest, off)
+	}
+	return n.Node.Read(file, dest, off, ctx)
+}
+func (n *UnixFSNode) Write(file nodefs.File, data []byte, off int64, ctx *fuse.Context) (uint32, fuse.Status) {
+	if f, ok := file.(*UnixFSFile); ok {
+		return f.write(ctx, data, off)
+	}
+	return n.Node.Write(file, data, off, ctx)
+}
+
 func (n *UnixFSNode) Mknod(name string, mode uint32, dev uint32, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	c, cancel := opContext(ctx, *flagTimeout)
+	defer cancel()
+
 	if dev != 0 {
 		// only allow regular files
 		return nil, fuse.ENODEV
 	}
-	if mode&^0777 == fuse.S_IFDIR {
+	if mode&syscall.S_IFMT == fuse.S_IFDIR {
 		return n.Mkdir(name, mode, ctx)
 	}
-	if mode&^0777 != fuse.S_IFREG {
+	if mode&syscall.S_IFMT != fuse.S_IFREG {
 		return nil, fuse.EINVAL
 	}
 
-	childPath := path.Join(n.Path, name)
-	resp, err := attachFile(ipfs.Request("files/write", childPath), nil).Option("create", true).Option("raw-leaves", true).Option("flush", false).Send(context.TODO())
-	if err == nil {
-		err = resp.Close()
-	}
-	if err == nil && resp.Error != nil {
-		if strings.HasSuffix(resp.Error.Message, " was not a file") {
-			return nil, fuse.Status(syscall.EEXIST)
-		}
-		err = resp.Error
+	childPath := path.Join(n.Path(), name)
+	err := n.Backend.Write(c, childPath, strings.NewReader(""), WriteOptions{Create: true, DAG: n.dagOptions()})
+	if errno(err) == syscall.EISDIR {
+		return nil, fuse.Status(syscall.EEXIST)
 	}
 	if err != nil {
-		log.Println("Mknod", childPath, err)
-		return nil, fuse.EIO
+		return nil, errorStatus(c, err, "Mknod", childPath)
 	}
+	n.invalidate()
 
-	return n.Inode().NewChild(name, false, &UnixFSNode{
-		Node: nodefs.NewDefaultNode(),
-		Path: childPath,
-	}), fuse.OK
+	// files/write does not give new files an mtime.
+	child := n.newChild(name)
+	child.modify()
+	child.stampModified(c)
+	n.chmodCreated(c, childPath, mode, 0644)
+	return n.Inode().NewChild(name, false, child), fuse.OK
 }
 
-func (n *UnixFSNode) Chmod(file nodefs.File, perms uint32, context *fuse.Context) (code fuse.Status) {
-	// We don't have modes, so just ignore the system call.
+// chmodCreated gives the file or directory p that was just created the
+// permissions in mode, if they are not the default perm that it shows
+// without any. Like its mtime, a failure does not undo the creation.
+func (n *UnixFSNode) chmodCreated(ctx context.Context, p string, mode, perm uint32) {
+	if mode&07777 == perm {
+		return
+	}
+	if err := n.Backend.Chmod(ctx, p, mode&07777); err != nil {
+		log.Println("Chmod", p+":", err)
+	}
+}
+
+func (n *UnixFSNode) Chmod(file nodefs.File, perms uint32, ctx *fuse.Context) fuse.Status {
+	if status := n.commitMetadata(ctx); status != fuse.OK {
+		return status
+	}
+
+	c, cancel := opContext(ctx, *flagTimeout)
+	defer cancel()
+
+	if err := n.Backend.Chmod(c, n.Path(), perms&07777); err != nil {
+		return errorStatus(c, err, "Chmod", n.Path())
+	}
+	n.setStat(nil)
 	return fuse.OK
 }
 func (n *UnixFSNode) Chown(file nodefs.File, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
@@ -325,57 +640,114 @@ func (n *UnixFSNode) Chown(file nodefs.File, uid uint32, gid uint32, context *fu
 	return fuse.OK
 }
 func (n *UnixFSNode) Utimens(file nodefs.File, atime *time.Time, mtime *time.Time, ctx *fuse.Context) fuse.Status {
-	// We don't have timestamps, so just ignore the system call.
+	// UnixFS has no atime.
+	if mtime == nil {
+		return fuse.OK
+	}
+	if status := n.commitMetadata(ctx); status != fuse.OK {
+		return status
+	}
+	// An mtime that is set explicitly replaces that of earlier writes.
+	n.mu.Lock()
+	n.modified = time.Time{}
+	n.mu.Unlock()
+
+	c, cancel := opContext(ctx, *flagTimeout)
+	defer cancel()
+
+	if err := n.Backend.Touch(c, n.Path(), *mtime); err != nil {
+		return errorStatus(c, err, "Utimens", n.Path())
+	}
+	n.setStat(nil)
 	return fuse.OK
 }
 
 func (n *UnixFSNode) Truncate(file nodefs.File, size uint64, ctx *fuse.Context) fuse.Status {
-	if size == 0 {
-		return n.rewrite(nil, ctx)
-	}
+	c, cancel := opContext(ctx, *flagIOTimeout)
+	defer cancel()
 
-	resp, err := ipfs.Request("files/read", n.Path).Option("flush", false).Send(context.TODO())
-	if err == nil && resp.Error != nil {
-		err = resp.Error
-	}
-	if err != nil {
-		log.Println("Truncate", n.Path, size, err)
-		return fuse.EIO
+	n.resetReadahead()
+	n.flushWrites(c)
+
+	if s := n.getSpool(); s != nil {
+		if err := n.truncateSpool(c, s, int64(size)); err != nil {
+			return errorStatus(c, err, "Truncate", n.Path(), size)
+		}
+		n.modify()
+		return fuse.OK
 	}
 
-	b, err := ioutil.ReadAll(resp.Output)
-	if e := resp.Close(); err == nil {
-		err = e
+	if size == 0 {
+		return n.rewrite(c, strings.NewReader(""), false)
 	}
+
+	stat, err := n.Backend.Stat(c, n.Path())
 	if err != nil {
-		log.Println("Truncate", n.Path, size, err)
-		return fuse.EIO
+		return errorStatus(c, err, "Truncate", n.Path(), size)
+	}
+	if stat == nil {
+		return fuse.ENOENT
 	}
 
-	if l := uint64(len(b)); l == size {
+	switch {
+	case stat.Size == size:
+		return fuse.OK
+	case stat.Size > size:
+		// files/write can only truncate a file to nothing, so the part
+		// that is kept has to be written again. Reading it from the old
+		// version of the file means it cannot change while we do that.
+		r, err := n.Backend.Cat(c, "/ipfs/"+stat.Hash, 0, int64(size))
+		if err != nil {
+			return errorStatus(c, err, "Truncate", n.Path(), size)
+		}
+		defer r.Close()
+		return n.rewrite(c, r, true)
+	case n.dagOptions().Chunker != defaultChunker:
+		// files/write would chunk the new part with the default chunker.
+		r, err := n.Backend.Cat(c, "/ipfs/"+stat.Hash, 0, -1)
+		if err != nil {
+			return errorStatus(c, err, "Truncate", n.Path(), size)
+		}
+		defer r.Close()
+		return n.rewrite(c, io.MultiReader(r, io.LimitReader(zeros{}, int64(size-stat.Size))), true)
+	default:
+		err = n.Backend.Write(c, n.Path(), io.LimitReader(zeros{}, int64(size-stat.Size)), WriteOptions{Offset: int64(stat.Size), DAG: n.dagOptions()})
+		if err != nil {
+			return errorStatus(c, err, "Truncate", n.Path(), size)
+		}
+		n.modify()
+		n.stampModified(c)
+		n.invalidate()
 		return fuse.OK
-	} else if l > size {
-		b = b[:size]
-	} else {
-		b = append(b, make([]byte, size-l)...)
 	}
-
-	return n.rewrite(b, ctx)
 }
 
-func (n *UnixFSNode) rewrite(b []byte, ctx *fuse.Context) fuse.Status {
-	resp, err := attachFile(ipfs.Request("files/write", n.Path), b).Option("flush", false).Option("raw-leaves", true).Option("truncate", true).Send(context.TODO())
-	if err == nil {
-		err = resp.Close()
-	}
-	if err == nil && resp.Error != nil {
-		err = resp.Error
+// rewrite replaces the content of n with r. If r is streamed from the
+// daemon, it is written aside first; see writeFileAside.
+func (n *UnixFSNode) rewrite(ctx context.Context, r io.Reader, streamed bool) fuse.Status {
+	var err error
+	if streamed {
+		err = writeFileAside(ctx, n.Backend, n.Path(), r, n.dagOptions())
+	} else {
+		err = writeFile(ctx, n.Backend, n.Path(), r, false, n.dagOptions())
 	}
-
 	if err != nil {
-		log.Println("Truncate", n.Path, err)
-		return fuse.EIO
+		return errorStatus(ctx, err, "Truncate", n.Path())
 	}
+	n.modify()
+	n.stampModified(ctx)
+	n.resetReadahead()
+	n.invalidate()
 
 	return fuse.OK
 }
+
+// zeros is an endless stream of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
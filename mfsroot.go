@@ -1,7 +1,7 @@
 package main
 
 import (
-	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 )
 
 type UnixFSRootNode struct {
@@ -9,6 +9,11 @@ type UnixFSRootNode struct {
 }
 
 func (n *UnixFSRootNode) OnMount(conn *nodefs.FileSystemConnector) {
-	n.Inode().NewChild("ipfs", true, ipfsRoot)
+	// /ipfs is a separate mount so that it can have its own cache timeouts.
+	opts := nodefs.NewOptions()
+	opts.EntryTimeout = immutableTimeout
+	opts.AttrTimeout = immutableTimeout
+	opts.NegativeTimeout = *flagNegativeTimeout
+	conn.Mount(n.Inode(), "ipfs", ipfsRoot, opts)
 	n.Inode().NewChild("ipns", true, ipnsRoot)
 }
@@ -0,0 +1,1161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/BenLubar/ipfs-fuse/ipfstest"
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+// mountTest mounts the filesystem against a fake daemon. The test is skipped
+// if FUSE is not available.
+func mountTest(t *testing.T) (d *ipfstest.Daemon, dir string, cleanup func()) {
+	d = ipfstest.NewDaemon()
+	dir, unmount := mountBackend(t, NewHTTPBackend(shell.NewShell(d.Addr())))
+	return d, dir, func() {
+		unmount()
+		d.Close()
+	}
+}
+
+func mountBackend(t *testing.T, backend Backend) (dir string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "ipfs-fuse-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := mount(backend, dir)
+	if err != nil {
+		os.Remove(dir)
+		t.Skip("cannot mount FUSE filesystem:", err)
+	}
+	go server.Serve()
+	if err := server.WaitMount(); err != nil {
+		os.Remove(dir)
+		t.Fatal(err)
+	}
+
+	return dir, func() {
+		if err := server.Unmount(); err != nil {
+			t.Error(err)
+		}
+		os.Remove(dir)
+	}
+}
+
+func TestMountFiles(t *testing.T) {
+	_, dir, cleanup := mountTest(t)
+	defer cleanup()
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "sub", "file.txt")
+	if err := ioutil.WriteFile(name, []byte("hello, world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(name); err != nil || string(data) != "hello, world" {
+		t.Errorf("read back %q, %v", data, err)
+	}
+
+	if err := os.Truncate(name, 5); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(name); err != nil || fi.Size() != 5 || !fi.Mode().IsRegular() {
+		t.Errorf("stat after truncate: %v, %v", fi, err)
+	}
+	if err := os.Truncate(name, 8); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(name); err != nil || string(data) != "hello\x00\x00\x00" {
+		t.Errorf("read after extending: %q, %v", data, err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "sub")); !isErrno(err, syscall.ENOTEMPTY) {
+		t.Errorf("rmdir non-empty directory: %v", err)
+	}
+	if err := os.Mkdir(name, 0755); !isErrno(err, syscall.EEXIST) {
+		t.Errorf("mkdir over file: %v", err)
+	}
+
+	renamed := filepath.Join(dir, "renamed.txt")
+	if err := os.Rename(name, renamed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("old name still exists: %v", err)
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	if want := []string{"ipfs", "ipns", "renamed.txt", "sub"}; !equalStrings(names, want) {
+		t.Errorf("readdir: got %v, want %v", names, want)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(renamed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMountIPFS(t *testing.T) {
+	d, dir, cleanup := mountTest(t)
+	defer cleanup()
+
+	hash := d.AddDir(map[string]string{"file": d.AddFile([]byte("immutable"))})
+	d.Publish("example", "/ipfs/"+hash)
+
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "ipfs", hash, "file")); err != nil || string(data) != "immutable" {
+		t.Errorf("read /ipfs: %q, %v", data, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ipfs", hash, "file"), nil, 0644); err == nil {
+		t.Error("write to /ipfs succeeded")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "ipns", "example", "file")); err != nil || string(data) != "immutable" {
+		t.Errorf("read /ipns: %q, %v", data, err)
+	}
+}
+
+func TestMountIPFSSymlink(t *testing.T) {
+	d, dir, cleanup := mountTest(t)
+	defer cleanup()
+
+	hash := d.AddDir(map[string]string{
+		"file": d.AddFile([]byte("immutable")),
+		"link": d.AddSymlink("file"),
+		"sub":  d.AddDir(map[string]string{"up": d.AddSymlink("../file")}),
+	})
+	root := filepath.Join(dir, "ipfs", hash)
+
+	for name, target := range map[string]string{"link": "file", "sub/up": "../file"} {
+		name = filepath.Join(root, name)
+		if s, err := os.Readlink(name); err != nil || s != target {
+			t.Errorf("readlink %s: %q, %v", name, s, err)
+		}
+		if fi, err := os.Lstat(name); err != nil || fi.Mode()&os.ModeSymlink == 0 || fi.Size() != int64(len(target)) {
+			t.Errorf("lstat %s: %v, %v", name, fi, err)
+		}
+		if data, err := ioutil.ReadFile(name); err != nil || string(data) != "immutable" {
+			t.Errorf("read %s: %q, %v", name, data, err)
+		}
+	}
+
+	f, err := os.Open(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := f.Readdir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range entries {
+		if isLink := fi.Mode()&os.ModeSymlink != 0; isLink != (fi.Name() == "link") {
+			t.Errorf("readdir: %s has mode %v", fi.Name(), fi.Mode())
+		}
+	}
+}
+
+func TestMountIPFSMetadata(t *testing.T) {
+	d, dir, cleanup := mountTest(t)
+	defer cleanup()
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	hash := d.AddDir(map[string]string{
+		"plain": d.AddFile([]byte("plain")),
+		"exec":  d.AddFileWithMetadata([]byte("#!/bin/sh"), 0775, mtime),
+	})
+	root := filepath.Join(dir, "ipfs", hash)
+
+	if fi, err := os.Stat(filepath.Join(root, "plain")); err != nil || fi.Mode() != 0444 || fi.ModTime().Unix() != 1 {
+		t.Errorf("without metadata: %v, %v", fi, err)
+	}
+	// Write permission is masked off.
+	if fi, err := os.Stat(filepath.Join(root, "exec")); err != nil || fi.Mode() != 0555 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("with metadata: %v, %v", fi, err)
+	}
+	if fi, err := os.Stat(root); err != nil || fi.Mode() != os.ModeDir|0555 {
+		t.Errorf("directory: %v, %v", fi, err)
+	}
+}
+
+// countingBackend counts requests for immutable content and writes.
+type countingBackend struct {
+	Backend
+	requests int32
+	reads    int32
+	writes   int32
+	copies   int32
+	failing  int32 // if set, writes fail
+	cutCat   int32 // if set, reads from /ipfs fail after the first byte
+	noTouch  int32 // if set, setting mtimes fails
+}
+
+func (b *countingBackend) Touch(ctx context.Context, path string, mtime time.Time) error {
+	if atomic.LoadInt32(&b.noTouch) != 0 {
+		return &shell.Error{Message: "unknown command \"touch\""}
+	}
+	return b.Backend.Touch(ctx, path, mtime)
+}
+
+func (b *countingBackend) Write(ctx context.Context, path string, data io.Reader, opts WriteOptions) error {
+	atomic.AddInt32(&b.writes, 1)
+	if atomic.LoadInt32(&b.failing) != 0 {
+		return &shell.Error{Message: "no space left on device"}
+	}
+	return b.Backend.Write(ctx, path, data, opts)
+}
+
+func (b *countingBackend) Read(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	atomic.AddInt32(&b.reads, 1)
+	return b.Backend.Read(ctx, path, offset, length)
+}
+
+func (b *countingBackend) Copy(ctx context.Context, src, dst string) error {
+	atomic.AddInt32(&b.copies, 1)
+	return b.Backend.Copy(ctx, src, dst)
+}
+
+func (b *countingBackend) Stat(ctx context.Context, path string) (*UnixFSStat, error) {
+	atomic.AddInt32(&b.requests, 1)
+	return b.Backend.Stat(ctx, path)
+}
+
+func (b *countingBackend) Cat(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	atomic.AddInt32(&b.requests, 1)
+	r, err := b.Backend.Cat(ctx, path, offset, length)
+	if err == nil && atomic.LoadInt32(&b.cutCat) != 0 {
+		r = cutReader{r}
+	}
+	return r, err
+}
+
+// cutReader returns one byte and then fails, like a stream that times out.
+type cutReader struct {
+	io.ReadCloser
+}
+
+func (r cutReader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if _, err := r.ReadCloser.Read(b[:1]); err != nil {
+		return 0, err
+	}
+	r.ReadCloser.Close()
+	return 1, context.DeadlineExceeded
+}
+
+func TestMountIPFSCache(t *testing.T) {
+	d := ipfstest.NewDaemon()
+	defer d.Close()
+	backend := &countingBackend{Backend: NewHTTPBackend(shell.NewShell(d.Addr()))}
+	dir, cleanup := mountBackend(t, backend)
+	defer cleanup()
+
+	hash := d.AddDir(map[string]string{"file": d.AddFile([]byte("immutable"))})
+	name := filepath.Join(dir, "ipfs", hash, "file")
+
+	if data, err := ioutil.ReadFile(name); err != nil || string(data) != "immutable" {
+		t.Fatalf("first read: %q, %v", data, err)
+	}
+	before := atomic.LoadInt32(&backend.requests)
+	for i := 0; i < 3; i++ {
+		if data, err := ioutil.ReadFile(name); err != nil || string(data) != "immutable" {
+			t.Errorf("read %d: %q, %v", i, data, err)
+		}
+	}
+	if after := atomic.LoadInt32(&backend.requests); after != before {
+		t.Errorf("repeated reads made %d requests to the daemon", after-before)
+	}
+}
+
+func TestMountWriteBuffer(t *testing.T) {
+	d := ipfstest.NewDaemon()
+	defer d.Close()
+	backend := &countingBackend{Backend: NewHTTPBackend(shell.NewShell(d.Addr()))}
+	dir, cleanup := mountBackend(t, backend)
+	defer cleanup()
+
+	name := filepath.Join(dir, "file")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []byte
+	for i := 0; i < 100; i++ {
+		chunk := bytes.Repeat([]byte{byte('a' + i%26)}, 1000)
+		if _, err := f.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, chunk...)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if writes := atomic.LoadInt32(&backend.writes); writes > 2 {
+		t.Errorf("100 writes were sent as %d requests", writes)
+	}
+	if data, err := ioutil.ReadFile(name); err != nil || !bytes.Equal(data, expected) {
+		t.Errorf("read back %d bytes, %v", len(data), err)
+	}
+
+	// A failed write is reported when the file is closed.
+	f, err = os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&backend.failing, 1)
+	defer atomic.StoreInt32(&backend.failing, 0)
+	if _, err := f.Write([]byte("lost")); err != nil {
+		t.Errorf("buffered write failed early: %v", err)
+	}
+	if err := f.Close(); !isErrno(err, syscall.ENOSPC) {
+		t.Errorf("close after failed write: %v", err)
+	}
+}
+
+func TestMountTruncateFailure(t *testing.T) {
+	d := ipfstest.NewDaemon()
+	defer d.Close()
+	backend := &countingBackend{Backend: NewHTTPBackend(shell.NewShell(d.Addr()))}
+	dir, cleanup := mountBackend(t, backend)
+	defer cleanup()
+
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The part that is kept is streamed back from the daemon. If that
+	// fails, the file is left as it was.
+	atomic.StoreInt32(&backend.cutCat, 1)
+	if err := os.Truncate(name, 5); err == nil {
+		t.Error("truncate succeeded with a broken stream")
+	}
+	atomic.StoreInt32(&backend.cutCat, 0)
+	if data, err := ioutil.ReadFile(name); err != nil || string(data) != "0123456789" {
+		t.Errorf("after failed truncate: %q, %v", data, err)
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 3 {
+		t.Errorf("%d entries after failed truncate", len(infos))
+	}
+
+	if err := os.Truncate(name, 5); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(name); err != nil || string(data) != "01234" {
+		t.Errorf("after truncate: %q, %v", data, err)
+	}
+}
+
+func TestMountReadaheadWrite(t *testing.T) {
+	_, dir, cleanup := mountTest(t)
+	defer cleanup()
+
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, bytes.Repeat([]byte("a"), 2<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading sequentially through one handle starts a streaming request
+	// that runs ahead of what the kernel asked for. O_DIRECT keeps the
+	// kernel's own readahead and page cache out of the way.
+	r, err := os.OpenFile(name, os.O_RDONLY|syscall.O_DIRECT, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.ReadFull(r, make([]byte, 512<<10)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A write through another handle must not be hidden by it.
+	w, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt([]byte("b"), 600<<10); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rest := make([]byte, 512<<10)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		t.Fatal(err)
+	}
+	if c := rest[(600-512)<<10]; c != 'b' {
+		t.Errorf("read %q after a write through another handle", c)
+	}
+}
+
+func TestMountAttrCache(t *testing.T) {
+	defer func(entry, attr time.Duration) {
+		*flagEntryTimeout, *flagAttrTimeout = entry, attr
+	}(*flagEntryTimeout, *flagAttrTimeout)
+	*flagEntryTimeout, *flagAttrTimeout = time.Hour, time.Hour
+
+	_, dir, cleanup := mountTest(t)
+	defer cleanup()
+
+	name := filepath.Join(dir, "file")
+	for _, size := range []int64{10, 3, 7} {
+		if err := ioutil.WriteFile(name, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if fi, err := os.Stat(name); err != nil || fi.Size() != size {
+			t.Errorf("after writing %d bytes: %v, %v", size, fi, err)
+		}
+	}
+
+	if err := os.Truncate(name, 1); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(name); err != nil || fi.Size() != 1 {
+		t.Errorf("after truncate: %v, %v", fi, err)
+	}
+
+	renamed := filepath.Join(dir, "renamed")
+	if err := os.Rename(name, renamed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("old name after rename: %v", err)
+	}
+	if fi, err := os.Stat(renamed); err != nil || fi.Size() != 1 {
+		t.Errorf("new name after rename: %v, %v", fi, err)
+	}
+
+	if err := os.Remove(renamed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(renamed); !os.IsNotExist(err) {
+		t.Errorf("after remove: %v", err)
+	}
+}
+
+func TestMountTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-hang:
+		}
+	}))
+	defer server.Close()
+	defer close(hang)
+
+	defer func(timeout time.Duration) { *flagTimeout = timeout }(*flagTimeout)
+	*flagTimeout = 100 * time.Millisecond
+
+	dir, cleanup := mountBackend(t, NewHTTPBackend(shell.NewShell(server.Listener.Addr().String())))
+	defer cleanup()
+
+	if _, err := os.Stat(filepath.Join(dir, "ipfs", "QmUnavailable")); !isErrno(err, syscall.ETIMEDOUT) {
+		t.Errorf("expected ETIMEDOUT, got %v", err)
+	}
+}
+
+func isErrno(err error, errno syscall.Errno) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		return e.Err == errno
+	case *os.LinkError:
+		return e.Err == errno
+	case syscall.Errno:
+		return e == errno
+	}
+	return false
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// optionsBackend records the DAG settings of the last write.
+type optionsBackend struct {
+	Backend
+	mu   sync.Mutex
+	last DAGOptions
+}
+
+func (b *optionsBackend) Write(ctx context.Context, path string, data io.Reader, opts WriteOptions) error {
+	b.mu.Lock()
+	b.last = opts.DAG
+	b.mu.Unlock()
+	return b.Backend.Write(ctx, path, data, opts)
+}
+
+func TestMountDAGOptions(t *testing.T) {
+	d := ipfstest.NewDaemon()
+	defer d.Close()
+	backend := &optionsBackend{Backend: NewHTTPBackend(shell.NewShell(d.Addr()))}
+	dir, cleanup := mountBackend(t, backend)
+	defer cleanup()
+
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Setxattr(sub, "user.ipfs-cid-version", []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Setxattr(sub, "user.ipfs-cid-version", []byte("2"), 0); !isErrno(err, syscall.EINVAL) {
+		t.Errorf("setting an invalid CID version: %v", err)
+	}
+	// files/write cannot use any other chunker, and -local-dag is not set.
+	for _, chunker := range []string{"rabin", "buzhash", "size-1024"} {
+		if err := syscall.Setxattr(sub, "user.ipfs-chunker", []byte(chunker), 0); !isErrno(err, syscall.EINVAL) {
+			t.Errorf("setting chunker %s: %v", chunker, err)
+		}
+	}
+
+	// Overrides follow the directory when it is renamed.
+	if err := os.Rename(sub, filepath.Join(dir, "renamed")); err != nil {
+		t.Fatal(err)
+	}
+	sub = filepath.Join(dir, "renamed")
+
+	for _, test := range []struct {
+		name       string
+		cidVersion string
+	}{
+		{filepath.Join(dir, "file"), "0"},
+		{filepath.Join(sub, "file"), "1"},
+	} {
+		if err := ioutil.WriteFile(test.name, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		backend.mu.Lock()
+		last := backend.last
+		backend.mu.Unlock()
+		if v := strconv.Itoa(last.CIDVersion); v != test.cidVersion || last.Chunker != "size-262144" {
+			t.Errorf("%s was written with %+v", test.name, last)
+		}
+
+		buf := make([]byte, 64)
+		n, err := syscall.Getxattr(test.name, "user.ipfs-cid-version", buf)
+		if err != nil || string(buf[:n]) != test.cidVersion {
+			t.Errorf("%s: user.ipfs-cid-version is %q, %v", test.name, buf[:n], err)
+		}
+	}
+
+	if err := syscall.Setxattr(filepath.Join(sub, "file"), "user.ipfs-cid-version", []byte("1"), 0); !isErrno(err, syscall.EPERM) {
+		t.Errorf("setting an override on a file: %v", err)
+	}
+}
+
+func TestMountRename(t *testing.T) {
+	d, dir, cleanup := mountTest(t)
+	defer cleanup()
+
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write a temporary file, then rename it over the original, with a
+	// handle to it still open.
+	tmp := filepath.Join(dir, "file.tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(" data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(name); err != nil || string(data) != "new data" {
+		t.Errorf("after replacing: %q, %v", data, err)
+	}
+	if infos, err := ioutil.ReadDir(dir); err != nil || len(infos) != 3 {
+		t.Errorf("after replacing: %v, %v", infos, err)
+	}
+
+	for _, sub := range []string{"a", "b", "c"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "c", "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// os.Rename refuses to replace directories, so use the system call.
+	if err := syscall.Rename(filepath.Join(dir, "a"), filepath.Join(dir, "c")); !isErrno(err, syscall.ENOTEMPTY) {
+		t.Errorf("rename over non-empty directory: %v", err)
+	}
+	if err := syscall.Rename(name, filepath.Join(dir, "b")); !isErrno(err, syscall.EISDIR) {
+		t.Errorf("rename file over directory: %v", err)
+	}
+	if err := syscall.Rename(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Errorf("rename over empty directory: %v", err)
+	}
+
+	hash := d.AddFile(nil)
+	d.Publish("example", "/ipfs/"+hash)
+	for _, target := range []string{
+		filepath.Join(dir, "ipfs", hash),
+		filepath.Join(dir, "ipns", "example"),
+	} {
+		if err := os.Rename(name, target); !isErrno(err, syscall.EXDEV) {
+			t.Errorf("rename to %s: %v", target, err)
+		}
+		if err := os.Rename(target, filepath.Join(dir, "moved")); !isErrno(err, syscall.EXDEV) {
+			t.Errorf("rename from %s: %v", target, err)
+		}
+	}
+}
+
+func TestMountRenameParent(t *testing.T) {
+	_, dir, cleanup := mountTest(t)
+	defer cleanup()
+
+	if err := os.MkdirAll(filepath.Join(dir, "a", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "a", "sub", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("before"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both the open handle and the cached inodes below the renamed
+	// directory have to follow it.
+	if err := os.Rename(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(" after"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(dir, "b", "sub", "file")
+	if data, err := ioutil.ReadFile(name); err != nil || string(data) != "before after" {
+		t.Errorf("after rename: %q, %v", data, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "b", "sub", "other"), []byte("x"), 0644); err != nil {
+		t.Errorf("create after rename: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+		t.Errorf("old name: %v", err)
+	}
+}
+
+func TestMountUnlinkOpen(t *testing.T) {
+	d, dir, cleanup := mountTest(t)
+	defer cleanup()
+
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("after unlink: %v", err)
+	}
+	if infos, err := ioutil.ReadDir(dir); err != nil || len(infos) != 2 {
+		t.Errorf("after unlink: %v, %v", infos, err)
+	}
+
+	if _, err := f.WriteAt([]byte(" more"), 4); err != nil {
+		t.Errorf("write after unlink: %v", err)
+	}
+	buf := make([]byte, 16)
+	if n, err := f.ReadAt(buf, 0); string(buf[:n]) != "data more" {
+		t.Errorf("read after unlink: %q, %v", buf[:n], err)
+	}
+
+	backend := NewHTTPBackend(shell.NewShell(d.Addr()))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Release happens after close returns.
+	var list *UnixFSList
+	for i := 0; i < 100; i++ {
+		if list, err = backend.List(context.Background(), instanceDir+"/", false); err != nil || list == nil || len(list.Entries) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil || list == nil || len(list.Entries) != 0 {
+		t.Errorf("after close: %v, %v", list, err)
+	}
+}
+
+func TestMountSnapshotReads(t *testing.T) {
+	*flagSnapshotReads = true
+	defer func() { *flagSnapshotReads = false }()
+
+	_, dir, cleanup := mountTest(t)
+	defer cleanup()
+
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, []byte("old data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if err := ioutil.WriteFile(name, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(r); err != nil || string(data) != "old data" {
+		t.Errorf("snapshot: %q, %v", data, err)
+	}
+	if data, err := ioutil.ReadFile(name); err != nil || string(data) != "new" {
+		t.Errorf("after reopening: %q, %v", data, err)
+	}
+}
+
+func TestMountLink(t *testing.T) {
+	_, dir, cleanup := mountTest(t)
+	defer cleanup()
+
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "sub", "link")
+	if err := os.Link(name, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(name, link); !os.IsExist(err) {
+		t.Errorf("link over existing file: %v", err)
+	}
+
+	// The link is a copy, not the same file.
+	if err := ioutil.WriteFile(name, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(link); err != nil || string(data) != "data" {
+		t.Errorf("link: %q, %v", data, err)
+	}
+}
+
+func TestMountLinkIPFS(t *testing.T) {
+	d, dir, cleanup := mountTest(t)
+	defer cleanup()
+
+	hash := d.AddDir(map[string]string{"file": d.AddFile([]byte("immutable"))})
+	src := filepath.Join(dir, "ipfs", hash, "file")
+	if _, err := os.Stat(src); err != nil {
+		t.Fatal(err)
+	}
+
+	// /ipfs is a separate go-fuse mount, which nodefs does not link from.
+	link := filepath.Join(dir, "copy")
+	if err := os.Link(src, link); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(link); err != nil || string(data) != "immutable" {
+		t.Errorf("link: %q, %v", data, err)
+	}
+	if err := ioutil.WriteFile(link, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(src); err != nil || string(data) != "immutable" {
+		t.Errorf("source after writing to the link: %q, %v", data, err)
+	}
+
+	// Directories cannot be linked.
+	if err := os.Link(filepath.Join(dir, "ipfs", hash), filepath.Join(dir, "dir")); err == nil {
+		t.Error("linked a directory")
+	}
+}
+
+func TestMountCopyFileRange(t *testing.T) {
+	d := ipfstest.NewDaemon()
+	defer d.Close()
+	backend := &countingBackend{Backend: NewHTTPBackend(shell.NewShell(d.Addr()))}
+	dir, cleanup := mountBackend(t, backend)
+	defer cleanup()
+
+	// copy does what io.Copy between two files does: copy_file_range.
+	copy := func(dst, src string, srcOff, dstOff, n int64) {
+		t.Helper()
+		r, err := os.Open(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Seek(srcOff, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Seek(dstOff, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.CopyN(w, r, n); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ipfs := filepath.Join(dir, "ipfs", d.AddFile([]byte("immutable")))
+
+	dst := filepath.Join(dir, "dst")
+	for _, test := range []struct {
+		src               string
+		srcOff, dstOff, n int64
+		expected          string
+	}{
+		// Whole files, into an empty file, become files/cp.
+		{src, 0, 0, 10, "0123456789"},
+		{ipfs, 0, 0, 9, "immutable"},
+		// Anything else is written over what is there.
+		{src, 2, 4, 3, "immu234le"},
+		{ipfs, 2, 8, 7, "immu234lmutable"},
+	} {
+		whole := test.srcOff == 0 && test.dstOff == 0
+		if whole {
+			if err := ioutil.WriteFile(dst, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		copies := atomic.LoadInt32(&backend.copies)
+		copy(dst, test.src, test.srcOff, test.dstOff, test.n)
+		if whole && atomic.LoadInt32(&backend.copies) == copies {
+			t.Errorf("copying all of %s did not use files/cp", test.src)
+		}
+		if data, err := ioutil.ReadFile(dst); err != nil || string(data) != test.expected {
+			t.Errorf("copying %d bytes of %s to offset %d: %q, %v", test.n, test.src, test.dstOff, data, err)
+		}
+	}
+}
+
+func TestMountSymlink(t *testing.T) {
+	d, dir, cleanup := mountTest(t)
+	defer cleanup()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", filepath.Join(dir, "link")); !os.IsExist(err) {
+		t.Errorf("symlink over existing file: %v", err)
+	}
+
+	// A symlink that was already in MFS.
+	backend := NewHTTPBackend(shell.NewShell(d.Addr()))
+	if err := backend.Copy(context.Background(), "/ipfs/"+d.AddSymlink("../file"), "/old"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, target := range map[string]string{"link": "file", "old": "../file"} {
+		name = filepath.Join(dir, name)
+		if s, err := os.Readlink(name); err != nil || s != target {
+			t.Errorf("readlink %s: %q, %v", name, s, err)
+		}
+		if fi, err := os.Lstat(name); err != nil || fi.Mode()&os.ModeSymlink == 0 || fi.Size() != int64(len(target)) {
+			t.Errorf("lstat %s: %v, %v", name, fi, err)
+		}
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "link")); err != nil || string(data) != "data" {
+		t.Errorf("through link: %q, %v", data, err)
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range infos {
+		if isLink := fi.Mode()&os.ModeSymlink != 0; isLink != (fi.Name() == "link" || fi.Name() == "old") {
+			t.Errorf("readdir: %s has mode %v", fi.Name(), fi.Mode())
+		}
+	}
+
+	// Symlinks are built with the settings of their directory.
+	block := symlinkNode("target")
+	sum256, sum512 := sha256.Sum256(block), sha512.Sum512(block)
+	for hash, mh := range map[string][]byte{
+		"sha2-256": append([]byte{0x12, 0x20}, sum256[:]...),
+		"sha2-512": append([]byte{0x13, 0x40}, sum512[:]...),
+		"blake3":   nil,
+	} {
+		sub := filepath.Join(dir, hash)
+		if err := os.Mkdir(sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Setxattr(sub, "user.ipfs-cid-version", []byte("1"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Setxattr(sub, "user.ipfs-hash-function", []byte(hash), 0); err != nil {
+			t.Fatal(err)
+		}
+		err := os.Symlink("target", filepath.Join(sub, "link"))
+		if mh == nil {
+			if err == nil {
+				t.Errorf("%s: symlink with a hash function the daemon rejects", hash)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		cid := cidString(append([]byte{1, codecDagPB}, mh...))
+		if _, err := backend.GetBlock(context.Background(), cid); err != nil {
+			t.Errorf("%s: %v", hash, err)
+		}
+		if target, err := os.Readlink(filepath.Join(sub, "link")); err != nil || target != "target" {
+			t.Errorf("%s: readlink %q, %v", hash, target, err)
+		}
+	}
+}
+
+func TestMountMetadata(t *testing.T) {
+	defer func(entry, attr time.Duration) {
+		*flagEntryTimeout, *flagAttrTimeout = entry, attr
+	}(*flagEntryTimeout, *flagAttrTimeout)
+	*flagEntryTimeout, *flagAttrTimeout = 0, 0
+
+	d, dir, cleanup := mountTest(t)
+	defer cleanup()
+
+	start := time.Now()
+	name := filepath.Join(dir, "file")
+	sub := filepath.Join(dir, "sub")
+	if err := ioutil.WriteFile(name, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files written through the mount get the time of the write.
+	modTime := func(name string) time.Time {
+		t.Helper()
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.ModTime()
+	}
+	if fi, err := os.Stat(name); err != nil || fi.Mode() != 0644 || fi.ModTime().Before(start) {
+		t.Errorf("after writing: %v, %v", fi, err)
+	}
+	old := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+	for what, change := range map[string]func() error{
+		"write":    func() error { return ioutil.WriteFile(name, []byte("more data"), 0644) },
+		"truncate": func() error { return os.Truncate(name, 2) },
+	} {
+		if err := os.Chtimes(name, old, old); err != nil {
+			t.Fatal(err)
+		}
+		if err := change(); err != nil {
+			t.Fatal(err)
+		}
+		if mtime := modTime(name); mtime.Before(start) {
+			t.Errorf("mtime after %s: %v", what, mtime)
+		}
+	}
+
+	// An mtime set while the file is open is not replaced when it is closed.
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if mtime := modTime(name); !mtime.Equal(old) {
+		t.Errorf("mtime after closing: %v", mtime)
+	}
+
+	// Files without metadata report when their content was first seen.
+	backend := NewHTTPBackend(shell.NewShell(d.Addr()))
+	ctx := context.Background()
+	if err := backend.Copy(ctx, "/ipfs/"+d.AddFile([]byte("one")), "/other"); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(dir, "other")
+	seen := modTime(other)
+	if seen.Before(start) {
+		t.Errorf("without metadata: %v", seen)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if mtime := modTime(other); !mtime.Equal(seen) {
+		t.Errorf("without metadata, again: %v, expected %v", mtime, seen)
+	}
+	if err := backend.Remove(ctx, "/other", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Copy(ctx, "/ipfs/"+d.AddFile([]byte("two")), "/other"); err != nil {
+		t.Fatal(err)
+	}
+	if mtime := modTime(other); !mtime.After(seen) {
+		t.Errorf("without metadata, changed: %v, first seen %v", mtime, seen)
+	}
+	if err := os.Remove(other); err != nil {
+		t.Fatal(err)
+	}
+	seenAt.Lock()
+	_, ok := seenAt.byPath["/other"]
+	seenAt.Unlock()
+	if ok {
+		t.Error("first seen time kept after removing")
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	if err := os.Chmod(name, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(sub, 0700|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(when string) {
+		if fi, err := os.Stat(name); err != nil || fi.Mode() != 0600 || !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: %v, %v", when, fi, err)
+		}
+		if fi, err := os.Stat(sub); err != nil || fi.Mode() != os.ModeDir|os.ModeSetgid|0700 {
+			t.Errorf("%s: %v, %v", when, fi, err)
+		}
+	}
+	check("after setting")
+	if _, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	check("after listing")
+}
+
+func TestMountCreateMode(t *testing.T) {
+	defer syscall.Umask(syscall.Umask(0))
+
+	_, dir, cleanup := mountTest(t)
+	defer cleanup()
+
+	// The kernel applies the umask, so it is cleared to test any mode.
+	for _, test := range []struct {
+		name   string
+		create func(name string) error
+		mode   os.FileMode
+	}{
+		{"dir", func(name string) error { return os.Mkdir(name, 0700) }, os.ModeDir | 0700},
+		{"default-dir", func(name string) error { return os.Mkdir(name, 0755) }, os.ModeDir | 0755},
+		{"file", func(name string) error { return ioutil.WriteFile(name, nil, 0755) }, 0755},
+		{"default-file", func(name string) error { return ioutil.WriteFile(name, nil, 0644) }, 0644},
+	} {
+		name := filepath.Join(dir, test.name)
+		if err := test.create(name); err != nil {
+			t.Fatal(err)
+		}
+		if fi, err := os.Stat(name); err != nil || fi.Mode() != test.mode {
+			t.Errorf("%s: %v, %v, expected mode %v", test.name, fi, err, test.mode)
+		}
+	}
+}
+
+func TestMountTouchFailure(t *testing.T) {
+	d := ipfstest.NewDaemon()
+	defer d.Close()
+	backend := &countingBackend{Backend: NewHTTPBackend(shell.NewShell(d.Addr()))}
+	dir, cleanup := mountBackend(t, backend)
+	defer cleanup()
+
+	// The data is written even if the mtime cannot be set.
+	atomic.StoreInt32(&backend.noTouch, 1)
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(name, 2); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(name); err != nil || string(data) != "da" {
+		t.Errorf("read back %q, %v", data, err)
+	}
+
+	// The time is stored with the next change that can be.
+	atomic.StoreInt32(&backend.noTouch, 0)
+	if err := ioutil.WriteFile(name, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := backend.Stat(context.Background(), "/file"); err != nil || stat.Mtime == 0 {
+		t.Errorf("after touch works again: %+v, %v", stat, err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+)
+
+// rawFS handles the requests that nodefs turns down before they reach the
+// nodes, and passes everything else on to it: links across its mounts,
+// which /ipfs is one of, and copy_file_range.
+type rawFS struct {
+	fuse.RawFileSystem
+}
+
+// probes holds the requests sent by resolve that have not been answered,
+// by their cancel channel.
+var probes sync.Map // of *probe
+
+type probe struct {
+	node nodefs.Node
+	file nodefs.File
+}
+
+// resolve returns the node with the given NodeId and, if fh is not nil, the
+// file of the handle *fh (only on Linux; see getAttrIn). nodefs keeps the
+// mapping to itself, so resolve sends it a GetAttr request with a cancel
+// channel of its own, which the node recognizes in answerProbe. The results
+// are nil for nodes that do not answer.
+func (fs *rawFS) resolve(nodeID uint64, fh *uint64) (nodefs.Node, nodefs.File) {
+	cancel := make(chan struct{})
+	p := &probe{}
+	probes.Store((<-chan struct{})(cancel), p)
+	defer probes.Delete((<-chan struct{})(cancel))
+
+	fs.RawFileSystem.GetAttr(cancel, getAttrIn(nodeID, fh), &fuse.AttrOut{})
+
+	if f, ok := p.file.(*nodefs.WithFlags); ok {
+		return p.node, f.File
+	}
+	return p.node, p.file
+}
+
+// answerProbe reports whether ctx is that of a request sent by resolve, and
+// if so answers it with n and file.
+func answerProbe(ctx *fuse.Context, n nodefs.Node, file nodefs.File) bool {
+	if ctx == nil || ctx.Cancel == nil {
+		return false
+	}
+	v, ok := probes.Load(ctx.Cancel)
+	if !ok {
+		return false
+	}
+	p := v.(*probe)
+	p.node, p.file = n, file
+	return true
+}
+
+func (fs *rawFS) Link(cancel <-chan struct{}, in *fuse.LinkIn, name string, out *fuse.EntryOut) fuse.Status {
+	code := fs.RawFileSystem.Link(cancel, in, name, out)
+	if code != fuse.Status(syscall.EXDEV) {
+		return code
+	}
+
+	existing, _ := fs.resolve(in.Oldnodeid, nil)
+	ipfs, ok := existing.(*IPFSNode)
+	if !ok {
+		return code
+	}
+	parent, _ := fs.resolve(in.NodeId, nil)
+	dir, ok := parent.(*UnixFSNode)
+	if !ok {
+		return code
+	}
+
+	c, cancelTimeout := opContext(&fuse.Context{Caller: in.Caller, Cancel: cancel}, *flagTimeout)
+	_, code = dir.copyFrom(c, "/ipfs/"+ipfs.Hash, name)
+	cancelTimeout()
+	if code != fuse.OK {
+		return code
+	}
+	// Looking the copy up gives the kernel the entry that link(2) returns.
+	return fs.RawFileSystem.Lookup(cancel, &in.InHeader, name, out)
+}
@@ -0,0 +1,14 @@
+package main
+
+import "github.com/hanwen/go-fuse/v2/fuse"
+
+// getAttrIn returns a GetAttr request for a node, which also asks for the
+// file of the handle *fh if fh is not nil.
+func getAttrIn(nodeID uint64, fh *uint64) *fuse.GetAttrIn {
+	in := &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: nodeID}}
+	if fh != nil {
+		in.Flags_ = fuse.FUSE_GETATTR_FH
+		in.Fh_ = *fh
+	}
+	return in
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "github.com/hanwen/go-fuse/v2/fuse"
+
+// getAttrIn returns a GetAttr request for a node. Only Linux has GetAttr
+// requests for a handle, so the file is not resolved here; that is only
+// needed for copy_file_range, which no other system sends.
+func getAttrIn(nodeID uint64, fh *uint64) *fuse.GetAttrIn {
+	return &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: nodeID}}
+}
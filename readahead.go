@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"sync"
+)
+
+var flagReadahead = flag.Int64("readahead", 16<<20, "maximum number of bytes to request ahead of sequential reads (0 to disable; not used for /ipfs with -cache-dir, which fetches whole chunks)")
+
+// readaheadMin is the size of the first streaming request once sequential
+// access is detected. Each following request is twice as large, up to
+// -readahead.
+const readaheadMin = 256 << 10
+
+// openFunc starts a request for length bytes of a file starting at offset.
+type openFunc func(ctx context.Context, offset, length int64) (io.ReadCloser, error)
+
+// readahead keeps a single streaming response open for a file handle while
+// it is being read sequentially, so that the daemon can send data ahead of
+// the kernel's requests. Random reads use one ranged request each. The zero
+// value is ready to use.
+type readahead struct {
+	mu     sync.Mutex
+	r      io.ReadCloser
+	cancel context.CancelFunc
+	pos    int64 // offset of the next byte from r
+	end    int64 // offset where the response for r ends
+	next   int64 // offset a sequential read would start at
+	window int64
+}
+
+// Read reads len(dest) bytes from offset off using open to make requests.
+// Only a short read at the end of the file returns fewer bytes without an
+// error.
+func (ra *readahead) Read(ctx context.Context, dest []byte, off int64, open openFunc) (int, error) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if ra.r != nil && off != ra.pos {
+		ra.close()
+	}
+	if off != ra.next || *flagReadahead <= 0 {
+		ra.close()
+		ra.window = 0
+
+		n, err := readRange(ctx, dest, off, open)
+		ra.next = off + int64(n)
+		return n, err
+	}
+
+	n := 0
+	for n < len(dest) {
+		if ra.r == nil {
+			if err := ra.open(off+int64(n), open); err != nil {
+				return n, err
+			}
+		}
+
+		m, err := readContext(ctx, ra.r, dest[n:])
+		n += m
+		ra.pos += int64(m)
+		ra.next = ra.pos
+		if err != nil {
+			ra.close()
+			return n, err
+		}
+		if n < len(dest) {
+			eof := ra.pos < ra.end
+			ra.close()
+			if eof {
+				break
+			}
+		}
+	}
+	return n, nil
+}
+
+// open starts the next streaming request, doubling the window.
+func (ra *readahead) open(off int64, open openFunc) error {
+	switch {
+	case ra.window == 0:
+		ra.window = readaheadMin
+	case ra.window < *flagReadahead:
+		ra.window *= 2
+	}
+	if ra.window > *flagReadahead {
+		ra.window = *flagReadahead
+	}
+
+	// The response outlives the FUSE operation that started it, so it
+	// cannot use that operation's context.
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := open(ctx, off, ra.window)
+	if err != nil {
+		cancel()
+		return err
+	}
+	ra.r, ra.cancel = r, cancel
+	ra.pos, ra.end = off, off+ra.window
+	return nil
+}
+
+func (ra *readahead) close() {
+	if ra.r != nil {
+		ra.r.Close()
+		ra.cancel()
+		ra.r, ra.cancel = nil, nil
+	}
+}
+
+// Reset drops the open response, for example because the file has changed
+// or the handle is being released.
+func (ra *readahead) Reset() {
+	ra.mu.Lock()
+	ra.close()
+	ra.window = 0
+	ra.next = -1
+	ra.mu.Unlock()
+}
+
+// readRange reads dest from a request for exactly that range.
+func readRange(ctx context.Context, dest []byte, off int64, open openFunc) (int, error) {
+	r, err := open(ctx, off, int64(len(dest)))
+	if err != nil {
+		return 0, err
+	}
+	n, err := readFull(r, dest)
+	if e := r.Close(); err == nil {
+		err = e
+	}
+	return n, err
+}
+
+// readContext is like readFull, but gives up when ctx is done. r is closed in
+// that case, as there is no other way to interrupt the read.
+func readContext(ctx context.Context, r io.ReadCloser, b []byte) (int, error) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.Close()
+		case <-done:
+		}
+	}()
+
+	n, err := readFull(r, b)
+	close(done)
+	if ctx.Err() != nil {
+		return n, ctx.Err()
+	}
+	return n, err
+}
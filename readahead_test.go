@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestReadahead(t *testing.T) {
+	data := make([]byte, 3<<20+100)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+
+	var requests []int64
+	open := func(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+		requests = append(requests, length)
+		end := offset + length
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		return ioutil.NopCloser(bytes.NewReader(data[offset:end])), nil
+	}
+
+	var ra readahead
+	defer ra.Reset()
+	ctx := context.Background()
+	buf := make([]byte, 128<<10)
+
+	var got []byte
+	for {
+		n, err := ra.Read(ctx, buf, int64(len(got)), open)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+		if n < len(buf) {
+			break
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("sequential read returned %d bytes, expected %d", len(got), len(data))
+	}
+	if len(requests) > 5 {
+		t.Errorf("sequential read made %d requests: %v", len(requests), requests)
+	}
+	for i := 1; i < len(requests); i++ {
+		if requests[i] < requests[i-1] {
+			t.Errorf("window shrank during sequential read: %v", requests)
+		}
+	}
+
+	// A seek falls back to a request for exactly the range that was read.
+	requests = nil
+	if n, err := ra.Read(ctx, buf[:10], 1000, open); err != nil || n != 10 || !bytes.Equal(buf[:10], data[1000:1010]) {
+		t.Errorf("random read: %d, %v", n, err)
+	}
+	if len(requests) != 1 || requests[0] != 10 {
+		t.Errorf("random read made requests %v", requests)
+	}
+}
@@ -3,15 +3,18 @@ package main
 import (
 	"context"
 	"io"
-	"log"
+	"io/ioutil"
 
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 )
 
 type ReadOnlyFile struct {
 	nodefs.File
-	Hash string
+	Backend Backend
+	Hash    string
+
+	ra readahead
 }
 
 // readFull is like io.ReadFull, but never considers EOF to be an error.
@@ -24,27 +27,74 @@ func readFull(r io.Reader, b []byte) (int, error) {
 }
 
 func (f *ReadOnlyFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
-	resp, err := ipfs.Request("cat", "/ipfs/"+f.Hash).Option("offset", off).Option("length", len(dest)).Send(context.TODO())
-	if err == nil && resp.Error != nil {
-		err = resp.Error
+	return f.read(nil, dest, off)
+}
+
+func (f *ReadOnlyFile) read(ctx *fuse.Context, dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	c, cancel := opContext(ctx, *flagIOTimeout)
+	defer cancel()
+
+	if blockCache != nil {
+		n, err := f.readCached(c, dest, off)
+		if err != nil {
+			return fuse.ReadResultData(dest[:n]), errorStatus(c, err, "Read", "/ipfs/"+f.Hash)
+		}
+		return fuse.ReadResultData(dest[:n]), fuse.OK
 	}
+
+	n, err := f.ra.Read(c, dest, off, f.cat)
+	result := fuse.ReadResultData(dest[:n])
 	if err != nil {
-		log.Println("Read", "/ipfs/"+f.Hash, err)
-		return nil, fuse.EIO
+		return result, errorStatus(c, err, "Read", "/ipfs/"+f.Hash)
 	}
 
-	n, err := readFull(resp.Output, dest)
-	result := fuse.ReadResultData(dest[:n])
+	return result, fuse.OK
+}
 
-	if e := resp.Close(); err != nil || e != nil {
-		if err == nil {
-			err = e
+func (f *ReadOnlyFile) cat(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	return f.Backend.Cat(ctx, "/ipfs/"+f.Hash, offset, length)
+}
+
+// readCached reads into dest from the block cache, fetching whole chunks from
+// the daemon on a miss.
+func (f *ReadOnlyFile) readCached(ctx context.Context, dest []byte, off int64) (int, error) {
+	n := 0
+	for n < len(dest) {
+		pos := off + int64(n)
+		chunk := pos / cacheChunkSize
+
+		data, ok := blockCache.Get(f.Hash, chunk)
+		if !ok {
+			r, err := f.Backend.Cat(ctx, "/ipfs/"+f.Hash, chunk*cacheChunkSize, cacheChunkSize)
+			if err != nil {
+				return n, err
+			}
+			data, err = ioutil.ReadAll(r)
+			if e := r.Close(); err == nil {
+				err = e
+			}
+			if err != nil {
+				return n, err
+			}
+			blockCache.Put(f.Hash, chunk, data)
+		}
+
+		start := pos - chunk*cacheChunkSize
+		if start >= int64(len(data)) {
+			break
+		}
+		n += copy(dest[n:], data[start:])
+
+		if len(data) < cacheChunkSize {
+			// end of file
+			break
 		}
-		log.Println("Read", "/ipfs/"+f.Hash, err)
-		return result, fuse.EIO
 	}
+	return n, nil
+}
 
-	return result, fuse.OK
+func (f *ReadOnlyFile) Release() {
+	f.ra.Reset()
 }
 
 func (f *ReadOnlyFile) Write(data []byte, off int64) (written uint32, code fuse.Status) {
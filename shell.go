@@ -3,128 +3,82 @@ package main
 import (
 	"bytes"
 	"context"
+	"io"
+	"io/ioutil"
 	"mime/multipart"
-	pathutil "path"
+	"strconv"
+	"strings"
+	"time"
 
 	shell "github.com/ipfs/go-ipfs-api"
 )
 
-var ipfs = shell.NewLocalShell()
-
-type NodeType int
-
-const (
-	Directory NodeType = 0
-	File      NodeType = 1
-)
-
-type UnixFSList struct {
-	Entries []UnixFSDirEntry
-}
-
-type UnixFSDirEntry struct {
-	Name string
-	Type NodeType
-	Size uint64
-	Hash string
+// HTTPBackend implements Backend using the daemon's HTTP RPC API.
+type HTTPBackend struct {
+	Shell *shell.Shell
 }
 
-type UnixFSStat struct {
-	Hash           string
-	Size           uint64
-	CumulativeSize uint64
-	Blocks         int
-	Type           string
-	WithLocality   bool
-	Local          bool
-	SizeLocal      uint64
+func NewHTTPBackend(sh *shell.Shell) *HTTPBackend {
+	return &HTTPBackend{Shell: sh}
 }
 
-func Stat(ctx context.Context, path string) (*UnixFSStat, error) {
+func (b *HTTPBackend) Stat(ctx context.Context, path string) (*UnixFSStat, error) {
 	var data UnixFSStat
-	if err := ipfs.Request("files/stat", path).Option("flush", false).Exec(ctx, &data); err != nil {
-		if ie, ok := err.(*shell.Error); ok && ie.Message == "file does not exist" {
+	if err := b.Shell.Request("files/stat", path).Option("flush", false).Exec(ctx, &data); err != nil {
+		if isNotExist(err) {
 			// Not Found
 			return nil, nil
 		}
+		if e, ok := err.(*shell.Error); ok && strings.Contains(strings.ToLower(e.Message), "unrecognized node type: symlink") {
+			// Older daemons cannot stat symlinks, but can list them.
+			return b.statSymlink(ctx, path)
+		}
 
 		return nil, err
 	}
 	return &data, nil
 }
 
-func List(ctx context.Context, path string, long bool) (*UnixFSList, error) {
-	var data UnixFSList
-	if err := ipfs.Request("files/ls", path).Option("flush", false).Option("l", long).Exec(ctx, &data); err != nil {
-		if ie, ok := err.(*shell.Error); ok && ie.Message == "file does not exist" {
-			// Not Found
-			return nil, nil
+func (b *HTTPBackend) statSymlink(ctx context.Context, path string) (*UnixFSStat, error) {
+	if strings.HasPrefix(path, "/ipfs/") {
+		var data struct {
+			Key string
 		}
-
-		return nil, err
+		if err := b.Shell.Request("block/stat", path).Exec(ctx, &data); err != nil {
+			return nil, err
+		}
+		return &UnixFSStat{Hash: data.Key, Type: "symlink"}, nil
 	}
-	return &data, nil
-}
-
-func FastStat(ctx context.Context, path string) (*UnixFSStat, error) {
-	// Stat-ing a directory is very slow.
 
-	// First thing to try: List it as if it were a directory.
-	list, err := List(ctx, path+"/", false)
+	list, err := b.List(ctx, path, true)
 	if err != nil || list == nil {
 		return nil, err
 	}
-
-	// The only entry is an unnamed file.
-	if len(list.Entries) == 1 && list.Entries[0].Name == "" {
-		// It is safe to call Stat on files for the most part.
-		return Stat(ctx, path)
+	if len(list.Entries) != 1 {
+		return nil, &shell.Error{Message: "unrecognized node type: Symlink"}
 	}
-
-	return &UnixFSStat{
-		Type: "directory",
-		Hash: "", // hash not available through this method
-		Size: uint64(len(list.Entries)),
-	}, nil
+	return &UnixFSStat{Hash: list.Entries[0].Hash, Type: "symlink"}, nil
 }
 
-func FastList(ctx context.Context, path string) (*UnixFSList, error) {
-	list, err := List(ctx, path+"/", false)
-	if err != nil || list == nil || len(list.Entries) == 0 ||
-		(len(list.Entries) == 1 && list.Entries[0].Name == "") {
-		return list, err
-	}
-
-	if len(list.Entries) > 100 {
-		// Bite the bullet and just go for the slow route.
-		return List(ctx, path+"/", true)
-	}
-
-	for _, entry := range list.Entries {
-		stat, err := FastStat(ctx, pathutil.Join(path, entry.Name))
-		if err != nil || stat == nil {
-			return nil, err
-		}
-
-		if stat.Type == "directory" {
-			entry.Type = Directory
-		} else {
-			entry.Type = File
+func (b *HTTPBackend) List(ctx context.Context, path string, long bool) (*UnixFSList, error) {
+	var data UnixFSList
+	if err := b.Shell.Request("files/ls", path).Option("flush", false).Option("l", long).Exec(ctx, &data); err != nil {
+		if isNotExist(err) {
+			// Not Found
+			return nil, nil
 		}
 
-		entry.Hash = stat.Hash
-		entry.Size = stat.Size
+		return nil, err
 	}
-
-	return list, nil
+	return &data, nil
 }
 
-func ListImmutable(ctx context.Context, path string) (*UnixFSList, error) {
+func (b *HTTPBackend) ListImmutable(ctx context.Context, path string) (*UnixFSList, error) {
 	var data struct {
 		Objects []shell.LsObject
 	}
-	if err := ipfs.Request("ls", path).Exec(ctx, &data); err != nil {
-		if ie, ok := err.(*shell.Error); ok && ie.Message == "file does not exist" {
+	if err := b.Shell.Request("ls", path).Exec(ctx, &data); err != nil {
+		if isNotExist(err) {
 			// Not Found
 			return nil, nil
 		}
@@ -138,6 +92,8 @@ func ListImmutable(ctx context.Context, path string) (*UnixFSList, error) {
 		switch l.Type {
 		case shell.TDirectory:
 			t = Directory
+		case shell.TSymlink:
+			t = Symlink
 		default:
 			t = File
 		}
@@ -152,12 +108,12 @@ func ListImmutable(ctx context.Context, path string) (*UnixFSList, error) {
 	return &list, nil
 }
 
-func Resolve(ctx context.Context, name string) (string, error) {
+func (b *HTTPBackend) Resolve(ctx context.Context, name string) (string, error) {
 	var data struct {
 		Path string
 	}
-	if err := ipfs.Request("resolve", "/ipns/"+name).Exec(ctx, &data); err != nil {
-		if ie, ok := err.(*shell.Error); ok && ie.Message == "file does not exist" {
+	if err := b.Shell.Request("resolve", "/ipns/"+name).Exec(ctx, &data); err != nil {
+		if isNotExist(err) {
 			// Not Found
 			return "", nil
 		}
@@ -166,21 +122,181 @@ func Resolve(ctx context.Context, name string) (string, error) {
 	return data.Path, nil
 }
 
-func attachFile(builder *shell.RequestBuilder, data []byte) *shell.RequestBuilder {
-	var buf bytes.Buffer
-	w := multipart.NewWriter(&buf)
-	pw, err := w.CreateFormFile("data", "file")
-	if err != nil {
-		panic(err)
+func (b *HTTPBackend) Cat(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	req := b.Shell.Request("cat", path).Option("offset", offset)
+	if length >= 0 {
+		req = req.Option("length", length)
+	}
+	return openResponse(req.Send(ctx))
+}
+
+func (b *HTTPBackend) Read(ctx context.Context, path string, offset, count int64) (io.ReadCloser, error) {
+	req := b.Shell.Request("files/read", path).Option("offset", offset).Option("flush", false)
+	if count >= 0 {
+		req = req.Option("count", count)
+	}
+	return openResponse(req.Send(ctx))
+}
+
+func (b *HTTPBackend) Write(ctx context.Context, path string, r io.Reader, opts WriteOptions) error {
+	req, done := attachFiles(b.Shell.Request("files/write", path), r)
+	defer done()
+
+	// files/write has no chunker option; it always uses the default.
+	req = req.Option("flush", false).Option("raw-leaves", opts.DAG.RawLeaves)
+	req = dagRequestOptions(req, opts.DAG)
+	if opts.Offset != 0 {
+		req = req.Option("offset", opts.Offset)
+	}
+	if opts.Create {
+		req = req.Option("create", true)
+	}
+	if opts.Truncate {
+		req = req.Option("truncate", true)
+	}
+	return closeResponse(req.Send(ctx))
+}
+
+func (b *HTTPBackend) PutBlocks(ctx context.Context, codec string, blocks [][]byte) error {
+	readers := make([]io.Reader, len(blocks))
+	for i, block := range blocks {
+		readers[i] = bytes.NewReader(block)
+	}
+	req, done := attachFiles(b.Shell.Request("block/put"), readers...)
+	defer done()
+
+	return closeResponse(req.Option("cid-codec", codec).Option("mhtype", "sha2-256").Send(ctx))
+}
+
+func (b *HTTPBackend) PutBlock(ctx context.Context, codec, hash string, block []byte) (string, error) {
+	req, done := attachFiles(b.Shell.Request("block/put"), bytes.NewReader(block))
+	defer done()
+
+	var data struct {
+		Key string
+	}
+	if err := req.Option("cid-codec", codec).Option("mhtype", hash).Exec(ctx, &data); err != nil {
+		return "", err
 	}
-	_, err = pw.Write(data)
+	return data.Key, nil
+}
+
+func (b *HTTPBackend) GetBlock(ctx context.Context, cid string) ([]byte, error) {
+	r, err := openResponse(b.Shell.Request("block/get", cid).Send(ctx))
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (b *HTTPBackend) Copy(ctx context.Context, src, dst string) error {
+	return closeResponse(b.Shell.Request("files/cp", src, dst).Option("flush", false).Send(ctx))
+}
+
+func (b *HTTPBackend) Mkdir(ctx context.Context, path string, opts DAGOptions) error {
+	return closeResponse(dagRequestOptions(b.Shell.Request("files/mkdir", path), opts).Send(ctx))
+}
+
+// dagRequestOptions adds the options shared by files/write and files/mkdir.
+func dagRequestOptions(req *shell.RequestBuilder, opts DAGOptions) *shell.RequestBuilder {
+	if opts.CIDVersion != 0 {
+		req = req.Option("cid-version", opts.CIDVersion)
+	}
+	if opts.Hash != "" {
+		req = req.Option("hash", opts.Hash)
+	}
+	return req
+}
+
+func (b *HTTPBackend) Chmod(ctx context.Context, path string, mode uint32) error {
+	return closeResponse(b.Shell.Request("files/chmod", strconv.FormatUint(uint64(mode), 8), path).Option("flush", false).Send(ctx))
+}
+
+func (b *HTTPBackend) Touch(ctx context.Context, path string, mtime time.Time) error {
+	req := b.Shell.Request("files/touch", path).Option("flush", false)
+	return closeResponse(req.Option("mtime", mtime.Unix()).Option("mtime-nsecs", mtime.Nanosecond()).Send(ctx))
+}
+
+func (b *HTTPBackend) Remove(ctx context.Context, path string, recursive bool) error {
+	req := b.Shell.Request("files/rm", path)
+	if recursive {
+		req = req.Option("recursive", true)
+	}
+	return closeResponse(req.Send(ctx))
+}
+
+func (b *HTTPBackend) Move(ctx context.Context, oldPath, newPath string) error {
+	return closeResponse(b.Shell.Request("files/mv", oldPath, newPath).Send(ctx))
+}
+
+func (b *HTTPBackend) Flush(ctx context.Context, path string) error {
+	return closeResponse(b.Shell.Request("files/flush", path).Send(ctx))
+}
+
+// closeResponse discards the body of a response, returning the first error
+// from sending the request, reading the body, or the daemon itself.
+func closeResponse(resp *shell.Response, err error) error {
+	if err == nil {
+		err = resp.Close()
+	}
+	if err == nil && resp.Error != nil {
+		err = resp.Error
+	}
+	return err
+}
+
+// openResponse returns the body of a response, or the error from sending the
+// request or from the daemon.
+func openResponse(resp *shell.Response, err error) (io.ReadCloser, error) {
+	if err == nil && resp.Error != nil {
+		err = resp.Error
 	}
-	err = w.Close()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	return responseBody{resp}, nil
+}
+
+type responseBody struct {
+	*shell.Response
+}
+
+func (r responseBody) Read(b []byte) (int, error) {
+	return r.Output.Read(b)
+}
+
+// attachFiles sends each reader as a file in the body of a request, encoded
+// as a multipart form, without holding all of it in memory. The returned
+// function must be called once the request is done; it waits until the
+// readers are no longer in use.
+func attachFiles(builder *shell.RequestBuilder, files ...io.Reader) (*shell.RequestBuilder, func()) {
+	pr, pw := io.Pipe()
+	w := multipart.NewWriter(pw)
+	stopped := make(chan struct{})
 
-	return builder.Body(&buf).Header("Content-Type", w.FormDataContentType())
+	go func() {
+		defer close(stopped)
+
+		var err error
+		for _, r := range files {
+			var part io.Writer
+			part, err = w.CreateFormFile("data", "file")
+			if err == nil {
+				_, err = io.Copy(part, r)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return builder.Body(pr).Header("Content-Type", w.FormDataContentType()), func() {
+		pr.Close()
+		<-stopped
+	}
 }
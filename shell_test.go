@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/BenLubar/ipfs-fuse/ipfstest"
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+func newTestBackend(t *testing.T) (*ipfstest.Daemon, *HTTPBackend) {
+	d := ipfstest.NewDaemon()
+	return d, NewHTTPBackend(shell.NewShell(d.Addr()))
+}
+
+func TestHTTPBackendFiles(t *testing.T) {
+	d, b := newTestBackend(t)
+	defer d.Close()
+	ctx := context.Background()
+
+	if err := b.Mkdir(ctx, "/dir", DAGOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Mkdir(ctx, "/dir", DAGOptions{}); err == nil || err.(*shell.Error).Message != "file already exists" {
+		t.Errorf("second mkdir: %v", err)
+	}
+	if err := b.Write(ctx, "/dir/file", strings.NewReader("hello"), WriteOptions{Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Write(ctx, "/dir/file", strings.NewReader(", world"), WriteOptions{Offset: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := b.Read(ctx, "/dir/file", 3, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if e := r.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "lo, world" {
+		t.Errorf("read %q", data)
+	}
+
+	stat, err := FastStat(ctx, b, "/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat == nil || stat.Type != "file" || stat.Size != 12 || stat.Hash == "" {
+		t.Errorf("stat file: %+v", stat)
+	}
+	stat, err = FastStat(ctx, b, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat == nil || stat.Type != "directory" || stat.Size != 1 {
+		t.Errorf("stat dir: %+v", stat)
+	}
+
+	if err := b.Move(ctx, "/dir/file", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Remove(ctx, "/dir", false); err == nil || err.(*shell.Error).Message != "/dir is a directory, use -r to remove directories" {
+		t.Errorf("rm dir: %v", err)
+	}
+	if err := b.Remove(ctx, "/dir", true); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := b.Stat(ctx, "/dir"); stat != nil || err != nil {
+		t.Errorf("stat removed dir: %+v, %v", stat, err)
+	}
+	if err := b.Flush(ctx, "/"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPBackendImmutable(t *testing.T) {
+	d, b := newTestBackend(t)
+	defer d.Close()
+	ctx := context.Background()
+
+	file := d.AddFile([]byte("immutable"))
+	dir := d.AddDir(map[string]string{"a": file, "b": d.AddDir(nil)})
+	d.Publish("example", "/ipfs/"+dir)
+
+	list, err := b.ListImmutable(ctx, "/ipfs/"+dir+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Entries) != 2 || list.Entries[0].Type != File || list.Entries[0].Hash != file || list.Entries[1].Type != Directory {
+		t.Errorf("ls: %+v", list)
+	}
+
+	r, err := b.Cat(ctx, "/ipfs/"+dir+"/a", 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if e := r.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "mut" {
+		t.Errorf("cat %q", data)
+	}
+
+	if p, err := b.Resolve(ctx, "example"); err != nil || p != "/ipfs/"+dir {
+		t.Errorf("resolve: %q, %v", p, err)
+	}
+	if p, err := b.Resolve(ctx, "missing"); err != nil || p != "" {
+		t.Errorf("resolve missing: %q, %v", p, err)
+	}
+}
+
+func TestParseMultiaddr(t *testing.T) {
+	for _, tt := range []struct {
+		addr, network, address, scheme string
+	}{
+		{"/ip4/127.0.0.1/tcp/5001", "tcp", "127.0.0.1:5001", "http"},
+		{"/ip6/::1/tcp/5001", "tcp", "[::1]:5001", "http"},
+		{"/dns4/ipfs.example.com/tcp/443/https", "tcp", "ipfs.example.com:443", "https"},
+		{"/unix/run/ipfs/api.sock", "unix", "/run/ipfs/api.sock", "http"},
+		{"/ip4/127.0.0.1/udp/5001", "", "", ""},
+	} {
+		network, address, scheme, err := parseMultiaddr(tt.addr)
+		if tt.network == "" {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.addr)
+			}
+			continue
+		}
+		if err != nil || network != tt.network || address != tt.address || scheme != tt.scheme {
+			t.Errorf("%s: got %q %q %q %v", tt.addr, network, address, scheme, err)
+		}
+	}
+}
+
+func TestNewShellUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-fuse-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := ipfstest.NewDaemon()
+	defer d.Close()
+
+	l, err := net.Listen("unix", filepath.Join(dir, "api.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(d)
+	server.Listener = l
+	server.Start()
+	defer server.Close()
+
+	sh, err := newShell("/unix"+filepath.Join(dir, "api.sock"), APIOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := NewHTTPBackend(sh).Stat(context.Background(), "/"); err != nil || stat == nil || stat.Type != "directory" {
+		t.Errorf("stat over unix socket: %+v, %v", stat, err)
+	}
+}
+
+func TestNewShellAuthTLS(t *testing.T) {
+	d := ipfstest.NewDaemon()
+	defer d.Close()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pa:ss" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		d.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	ca, err := ioutil.TempFile("", "ipfs-fuse-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(ca.Name())
+	err = pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if e := ca.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sh, err := newShell(server.URL, APIOptions{Auth: "basic:user:pa:ss", CAFile: ca.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewHTTPBackend(sh)
+	ctx := context.Background()
+	if err := b.Write(ctx, "/file", strings.NewReader("data"), WriteOptions{Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := b.Stat(ctx, "/file"); err != nil || stat == nil || stat.Size != 4 {
+		t.Errorf("stat: %+v, %v", stat, err)
+	}
+
+	sh, err = newShell(server.URL, APIOptions{CAFile: ca.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewHTTPBackend(sh).Stat(ctx, "/file"); err == nil {
+		t.Error("request without credentials succeeded")
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var flagSpoolDir = flag.String("spool-dir", "", "directory to stage MFS files that are open for writing in, committing them when they are closed (default: write to MFS directly)")
+
+// spoolFile is a local copy of an MFS file that is open for writing. All
+// handles of the file use it instead of MFS until the last one that opened
+// it for writing is released, and then it is written back in one request.
+//
+// The current content of the file is only downloaded when it is first
+// needed, so that a file that is truncated to nothing right after it is
+// opened, as open(2) with O_TRUNC does, is never downloaded. Until then,
+// reads go to MFS.
+//
+// Each spool file is accompanied by a file with the same name plus ".path"
+// that holds the path in MFS, so that it can be recovered after a crash. It
+// is only written once the spool file is complete, and written again when
+// the file or one of its parents is renamed.
+type spoolFile struct {
+	file   *os.File
+	refs   int  // guarded by UnixFSNode.spoolMu
+	dirty  bool // guarded by UnixFSNode.spoolMu
+	filled bool // guarded by UnixFSNode.spoolMu and UnixFSNode.mu
+
+	pathMu sync.Mutex
+	path   string // in the .path file
+}
+
+// spooled is the set of nodes that have a spool file.
+var spooled = struct {
+	sync.Mutex
+	nodes map[*UnixFSNode]bool
+}{nodes: make(map[*UnixFSNode]bool)}
+
+func (n *UnixFSNode) getSpool() *spoolFile {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.spool
+}
+
+// filledSpool returns the spool file of n if it holds the content of the
+// file, which MFS does not have.
+func (n *UnixFSNode) filledSpool() *spoolFile {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.spool == nil || !n.spool.filled {
+		return nil
+	}
+	return n.spool
+}
+
+// openSpool returns the spool file for n, creating an empty one if there is
+// none yet. If trunc is set, the file is truncated.
+func (n *UnixFSNode) openSpool(ctx context.Context, trunc bool) (*spoolFile, error) {
+	n.spoolMu.Lock()
+	defer n.spoolMu.Unlock()
+
+	s := n.getSpool()
+	if s == nil {
+		f, err := ioutil.TempFile(*flagSpoolDir, "spool")
+		if err != nil {
+			return nil, err
+		}
+		s = &spoolFile{file: f}
+		n.mu.Lock()
+		n.spool = s
+		n.mu.Unlock()
+
+		spooled.Lock()
+		spooled.nodes[n] = true
+		spooled.Unlock()
+	}
+	s.refs++
+
+	if trunc {
+		if err := n.truncateSpoolLocked(ctx, s, 0); err != nil {
+			n.releaseSpoolLocked(ctx)
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// fillSpool downloads the content of n into its spool file if that has not
+// happened yet.
+func (n *UnixFSNode) fillSpool(ctx context.Context, s *spoolFile) error {
+	if s.filled {
+		return nil
+	}
+
+	// Writes from handles that were opened earlier have to be included.
+	n.flushWrites(ctx)
+
+	r, err := n.Backend.Read(ctx, n.Path(), 0, -1)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(s.file, r)
+	if e := r.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		s.file.Truncate(0)
+		return err
+	}
+	return n.spoolFilled(s)
+}
+
+// spoolFilled records that s holds the content of n.
+func (n *UnixFSNode) spoolFilled(s *spoolFile) error {
+	if err := n.writeSpoolPath(s); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	s.filled = true
+	n.mu.Unlock()
+	return nil
+}
+
+// writeSpoolPath writes the current path of n to the .path file of s. The
+// new path is written next to it and renamed over it, so that a crash
+// leaves either the old or the new one.
+func (n *UnixFSNode) writeSpoolPath(s *spoolFile) error {
+	s.pathMu.Lock()
+	defer s.pathMu.Unlock()
+
+	p := n.Path()
+	if p == s.path {
+		return nil
+	}
+	name := s.file.Name() + ".path"
+	if err := ioutil.WriteFile(name+".tmp", []byte(p), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	s.path = p
+	return nil
+}
+
+// updateSpoolPaths rewrites the .path files of the spool files whose nodes
+// have moved.
+func updateSpoolPaths() {
+	spooled.Lock()
+	defer spooled.Unlock()
+
+	for n := range spooled.nodes {
+		if s := n.filledSpool(); s != nil {
+			if err := n.writeSpoolPath(s); err != nil {
+				log.Println("Cannot update", s.file.Name()+".path:", err)
+			}
+		}
+	}
+}
+
+// releaseSpool drops a reference to the spool file, committing and removing
+// it if it was the last one.
+func (n *UnixFSNode) releaseSpool(ctx context.Context) error {
+	n.spoolMu.Lock()
+	defer n.spoolMu.Unlock()
+
+	return n.releaseSpoolLocked(ctx)
+}
+
+func (n *UnixFSNode) releaseSpoolLocked(ctx context.Context) error {
+	s := n.getSpool()
+	if s.refs--; s.refs > 0 {
+		return nil
+	}
+
+	err := n.commitSpoolLocked(ctx)
+	if isNotExist(err) {
+		// The file was removed while it was open.
+		err = nil
+	}
+	if err != nil {
+		// Keep the data around to be recovered.
+		s.file.Close()
+	} else {
+		removeSpool(s.file)
+	}
+
+	n.mu.Lock()
+	n.spool = nil
+	n.mu.Unlock()
+	spooled.Lock()
+	delete(spooled.nodes, n)
+	spooled.Unlock()
+	n.invalidate()
+	return err
+}
+
+// commitSpool writes the spool file of n, if it has one, to MFS.
+func (n *UnixFSNode) commitSpool(ctx context.Context) error {
+	n.spoolMu.Lock()
+	defer n.spoolMu.Unlock()
+
+	return n.commitSpoolLocked(ctx)
+}
+
+func (n *UnixFSNode) commitSpoolLocked(ctx context.Context) error {
+	s := n.getSpool()
+	if s == nil || !s.dirty {
+		return nil
+	}
+
+	fi, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	r := io.NewSectionReader(s.file, 0, fi.Size())
+	if err := writeFile(ctx, n.Backend, n.Path(), r, false, n.dagOptions()); err != nil {
+		return err
+	}
+	n.resetReadahead()
+	n.stampModified(ctx)
+	if err := n.Backend.Flush(ctx, n.Path()); err != nil {
+		return err
+	}
+	s.dirty = false
+
+	stat, err := n.Backend.Stat(ctx, n.Path())
+	if err != nil {
+		return err
+	}
+	if stat != nil {
+		n.setStat(stat)
+		log.Println("Committed", n.Path(), "as", stat.Hash)
+	}
+	return nil
+}
+
+// writeSpool writes to the spool file of n.
+func (n *UnixFSNode) writeSpool(ctx context.Context, s *spoolFile, data []byte, off int64) error {
+	n.spoolMu.Lock()
+	defer n.spoolMu.Unlock()
+
+	if err := n.fillSpool(ctx, s); err != nil {
+		return err
+	}
+	s.dirty = true
+	_, err := s.file.WriteAt(data, off)
+	return err
+}
+
+func (n *UnixFSNode) truncateSpool(ctx context.Context, s *spoolFile, size int64) error {
+	n.spoolMu.Lock()
+	defer n.spoolMu.Unlock()
+
+	return n.truncateSpoolLocked(ctx, s, size)
+}
+
+func (n *UnixFSNode) truncateSpoolLocked(ctx context.Context, s *spoolFile, size int64) error {
+	if size == 0 && !s.filled {
+		// There is nothing to download.
+		if err := s.file.Truncate(0); err != nil {
+			return err
+		}
+		if err := n.spoolFilled(s); err != nil {
+			return err
+		}
+	} else if err := n.fillSpool(ctx, s); err != nil {
+		return err
+	}
+	s.dirty = true
+	return s.file.Truncate(size)
+}
+
+func removeSpool(f *os.File) {
+	f.Close()
+	os.Remove(f.Name() + ".path")
+	os.Remove(f.Name())
+}
+
+// recoverSpool writes back spool files left over from a previous run that
+// did not exit cleanly. Files that cannot be written back are left alone,
+// and files that were never completed are removed.
+func recoverSpool(ctx context.Context, backend Backend, dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "spool*"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, ".path") {
+			continue
+		}
+		if _, err := os.Stat(name + ".path"); os.IsNotExist(err) {
+			os.Remove(name)
+		}
+	}
+
+	names, err = filepath.Glob(filepath.Join(dir, "spool*.path"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		mfsPath := string(b)
+
+		f, err := os.Open(strings.TrimSuffix(name, ".path"))
+		if err != nil {
+			return err
+		}
+		err = writeFile(ctx, backend, mfsPath, f, true, defaultDAGOptions())
+		if err == nil {
+			err = backend.Flush(ctx, mfsPath)
+		}
+		if err != nil {
+			f.Close()
+			log.Println("Cannot recover", mfsPath, "from", f.Name()+":", err)
+			continue
+		}
+
+		log.Println("Recovered", mfsPath, "from", f.Name())
+		removeSpool(f)
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BenLubar/ipfs-fuse/ipfstest"
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+func readMFS(t *testing.T, b Backend, path string) string {
+	r, err := b.Read(context.Background(), path, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestMountSpool(t *testing.T) {
+	spool, err := ioutil.TempDir("", "ipfs-fuse-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spool)
+	defer func(dir string) { *flagSpoolDir = dir }(*flagSpoolDir)
+	*flagSpoolDir = spool
+
+	d := ipfstest.NewDaemon()
+	defer d.Close()
+	backend := &countingBackend{Backend: NewHTTPBackend(shell.NewShell(d.Addr()))}
+	dir, cleanup := mountBackend(t, backend)
+	defer cleanup()
+
+	f, err := os.Create(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := atomic.LoadInt32(&backend.writes)
+
+	// A second handle shares the same spool file.
+	g, err := os.OpenFile(filepath.Join(dir, "file"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("hello world"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.WriteAt([]byte("J"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(5); err != nil {
+		t.Fatal(err)
+	}
+	if writes := atomic.LoadInt32(&backend.writes); writes != created {
+		t.Errorf("%d writes reached the daemon before the file was closed", writes-created)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if data := readMFS(t, backend, "/file"); data != "Jello" {
+		t.Errorf("after fsync: %q", data)
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacing the whole file does not download it first.
+	reads := atomic.LoadInt32(&backend.reads)
+	f, err = os.OpenFile(filepath.Join(dir, "file"), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&backend.reads) - reads; n != 0 {
+		t.Errorf("%d reads for a file opened with O_TRUNC", n)
+	}
+	if data := readMFS(t, backend, "/file"); data != "new" {
+		t.Errorf("after O_TRUNC: %q", data)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Release happens after close returns.
+	for i := 0; i < 100; i++ {
+		if names, _ := filepath.Glob(filepath.Join(spool, "*")); len(names) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if names, _ := filepath.Glob(filepath.Join(spool, "*")); len(names) != 0 {
+		t.Errorf("spool files left after release: %v", names)
+	}
+}
+
+func TestMountSpoolRename(t *testing.T) {
+	spool, err := ioutil.TempDir("", "ipfs-fuse-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spool)
+	defer func(dir string) { *flagSpoolDir = dir }(*flagSpoolDir)
+	*flagSpoolDir = spool
+
+	_, dir, cleanup := mountTest(t)
+	defer cleanup()
+
+	if err := os.Mkdir(filepath.Join(dir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "a", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString("data"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash now has to recover the file where it is now, not where it
+	// was when it was opened.
+	if err := os.Rename(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	names, err := filepath.Glob(filepath.Join(spool, "*.path"))
+	if err != nil || len(names) != 1 {
+		t.Fatalf("path files: %v, %v", names, err)
+	}
+	if p, err := ioutil.ReadFile(names[0]); err != nil || string(p) != "/b/file" {
+		t.Errorf("path file after rename: %q, %v", p, err)
+	}
+}
+
+func TestRecoverSpool(t *testing.T) {
+	spool, err := ioutil.TempDir("", "ipfs-fuse-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spool)
+
+	d, b := newTestBackend(t)
+	defer d.Close()
+
+	// Recovered files go through files/cp when the DAG is built locally.
+	defer func(local bool) { *flagLocalDAG = local }(*flagLocalDAG)
+	*flagLocalDAG = true
+
+	name := filepath.Join(spool, "spool123")
+	if err := ioutil.WriteFile(name, []byte("recovered"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name+".path", []byte("/lost"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Without a .path file, the spool file was never complete.
+	if err := ioutil.WriteFile(filepath.Join(spool, "spool456"), []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := recoverSpool(context.Background(), b, spool); err != nil {
+		t.Fatal(err)
+	}
+	if data := readMFS(t, b, "/lost"); data != "recovered" {
+		t.Errorf("recovered %q", data)
+	}
+	for _, name := range []string{name, filepath.Join(spool, "spool456")} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("spool file was not removed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"path"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+)
+
+// readlink returns the target of the symlink with the given hash. The last
+// one is kept, since the target for a hash never changes.
+func (n *UnixFSNode) readlink(ctx context.Context, hash string) (string, error) {
+	n.mu.Lock()
+	if n.linkHash == hash {
+		defer n.mu.Unlock()
+		return n.linkTarget, nil
+	}
+	n.mu.Unlock()
+
+	block, err := n.Backend.GetBlock(ctx, hash)
+	if err != nil {
+		return "", err
+	}
+	target, err := symlinkTarget(block)
+	if err != nil {
+		return "", err
+	}
+
+	n.mu.Lock()
+	n.linkHash, n.linkTarget = hash, target
+	n.mu.Unlock()
+	return target, nil
+}
+
+// linkAttr sets the size of a symlink to the length of its target.
+func (n *UnixFSNode) linkAttr(ctx context.Context, out *fuse.Attr, stat *UnixFSStat) error {
+	if stat.Type != "symlink" {
+		return nil
+	}
+	target, err := n.readlink(ctx, stat.Hash)
+	if err != nil {
+		return err
+	}
+	out.Size = uint64(len(target))
+	out.Blocks = out.Size
+	return nil
+}
+
+func (n *UnixFSNode) Readlink(ctx *fuse.Context) ([]byte, fuse.Status) {
+	c, cancel := opContext(ctx, *flagTimeout)
+	defer cancel()
+
+	stat, err := n.stat(c)
+	if err != nil {
+		return nil, errorStatus(c, err, "Readlink", n.Path())
+	}
+	if stat == nil {
+		return nil, fuse.ENOENT
+	}
+	if stat.Type != "symlink" {
+		return nil, fuse.EINVAL
+	}
+
+	target, err := n.readlink(c, stat.Hash)
+	if err != nil {
+		return nil, errorStatus(c, err, "Readlink", n.Path())
+	}
+	return []byte(target), fuse.OK
+}
+
+// Symlink adds a UnixFS symlink node with the settings of n to the
+// blockstore and copies it into MFS.
+func (n *UnixFSNode) Symlink(name, content string, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	c, cancel := opContext(ctx, *flagTimeout)
+	defer cancel()
+
+	childPath := path.Join(n.Path(), name)
+	if n.isHidden(name) {
+		return nil, fuse.Status(syscall.EEXIST)
+	}
+
+	opts := n.dagOptions()
+	block := symlinkNode(content)
+	var hash string
+	if opts.Hash == "sha2-256" {
+		link, err := putBlock(codecDagPB, opts.CIDVersion, block, func(uint64, []byte) error {
+			return n.Backend.PutBlocks(c, "dag-pb", [][]byte{block})
+		})
+		if err != nil {
+			return nil, errorStatus(c, err, "Symlink", childPath)
+		}
+		hash = cidString(link.cid)
+	} else {
+		// Only sha2-256 CIDs are computed here. The daemon uses CIDv1
+		// for every other hash function anyway.
+		var err error
+		hash, err = n.Backend.PutBlock(c, "dag-pb", opts.Hash, block)
+		if err != nil {
+			return nil, errorStatus(c, err, "Symlink", childPath)
+		}
+	}
+	if err := n.Backend.Copy(c, "/ipfs/"+hash, childPath); err != nil {
+		return nil, errorStatus(c, err, "Symlink", childPath)
+	}
+	n.invalidate()
+
+	node := n.newChild(name)
+	node.setStat(&UnixFSStat{Hash: hash, Size: uint64(len(content)), Type: "symlink"})
+	node.linkHash, node.linkTarget = hash, content
+	return n.Inode().NewChild(name, false, node), fuse.OK
+}
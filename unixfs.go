@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+const (
+	codecRaw   = 0x55
+	codecDagPB = 0x70
+
+	// maxLinks is the number of children of each node in the daemon's
+	// balanced file layout.
+	maxLinks = 174
+)
+
+// dagLink is a block that has been built, as seen from its parent.
+type dagLink struct {
+	cid      []byte // binary CID
+	fileSize uint64 // bytes of file content below this block
+	tsize    uint64 // bytes of blocks below and including this block
+}
+
+// buildFile chunks r into a UnixFS file with the same balanced layout as the
+// daemon uses. put is called with every block, children before parents. The
+// root CID is returned as a string.
+func buildFile(r io.Reader, opts DAGOptions, put func(codec uint64, block []byte) error) (string, error) {
+	if opts.Hash != "sha2-256" {
+		return "", fmt.Errorf("cannot build a DAG with hash %s", opts.Hash)
+	}
+	chunks, err := newSplitter(r, opts.Chunker)
+	if err != nil {
+		return "", err
+	}
+
+	var level []dagLink
+	for {
+		chunk, err := chunks.next()
+		if err == io.EOF && len(level) != 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+
+		// An empty file still has one empty leaf.
+		var link dagLink
+		if opts.RawLeaves {
+			link, err = putBlock(codecRaw, 1, chunk, put)
+		} else {
+			data := unixfsData(chunk, uint64(len(chunk)), nil)
+			link, err = putBlock(codecDagPB, opts.CIDVersion, pbNode(nil, data), put)
+		}
+		if err != nil {
+			return "", err
+		}
+		link.fileSize = uint64(len(chunk))
+		level = append(level, link)
+	}
+
+	for len(level) > 1 {
+		var next []dagLink
+		for i := 0; i < len(level); i += maxLinks {
+			children := level[i:]
+			if len(children) > maxLinks {
+				children = children[:maxLinks]
+			}
+
+			var fileSize uint64
+			sizes := make([]uint64, len(children))
+			for j, c := range children {
+				sizes[j] = c.fileSize
+				fileSize += c.fileSize
+			}
+			block := pbNode(children, unixfsData(nil, fileSize, sizes))
+			link, err := putBlock(codecDagPB, opts.CIDVersion, block, put)
+			if err != nil {
+				return "", err
+			}
+			link.fileSize = fileSize
+			for _, c := range children {
+				link.tsize += c.tsize
+			}
+			next = append(next, link)
+		}
+		level = next
+	}
+
+	return cidString(level[0].cid), nil
+}
+
+func putBlock(codec uint64, version int, block []byte, put func(uint64, []byte) error) (dagLink, error) {
+	if err := put(codec, block); err != nil {
+		return dagLink{}, err
+	}
+
+	sum := sha256.Sum256(block)
+	cid := append([]byte{0x12, 0x20}, sum[:]...)
+	if version != 0 || codec != codecDagPB {
+		prefix := make([]byte, 1+binary.MaxVarintLen64)
+		prefix[0] = 1
+		cid = append(prefix[:1+binary.PutUvarint(prefix[1:], codec)], cid...)
+	}
+	return dagLink{cid: cid, tsize: uint64(len(block))}, nil
+}
+
+// pbNode encodes a dag-pb node. Links come before data, as required by the
+// canonical form.
+func pbNode(links []dagLink, data []byte) []byte {
+	var b []byte
+	for _, l := range links {
+		var lb []byte
+		lb = pbBytes(lb, 1, l.cid)
+		lb = pbBytes(lb, 2, nil)
+		lb = pbVarint(lb, 3, l.tsize)
+		b = pbBytes(b, 2, lb)
+	}
+	return pbBytes(b, 1, data)
+}
+
+// unixfsData encodes the UnixFS metadata of a file node.
+func unixfsData(data []byte, fileSize uint64, blockSizes []uint64) []byte {
+	var b []byte
+	b = pbVarint(b, 1, 2) // Type: File
+	if len(data) != 0 {
+		b = pbBytes(b, 2, data)
+	}
+	b = pbVarint(b, 3, fileSize)
+	for _, s := range blockSizes {
+		b = pbVarint(b, 4, s)
+	}
+	return b
+}
+
+// symlinkNode encodes a UnixFS symlink to target.
+func symlinkNode(target string) []byte {
+	var b []byte
+	b = pbVarint(b, 1, 4) // Type: Symlink
+	b = pbBytes(b, 2, []byte(target))
+	return pbNode(nil, b)
+}
+
+// symlinkTarget decodes a UnixFS symlink.
+func symlinkTarget(block []byte) (string, error) {
+	_, data, err := pbField(block, 1)
+	if err != nil {
+		return "", err
+	}
+	t, _, err := pbField(data, 1)
+	if err != nil {
+		return "", err
+	}
+	if t != 4 {
+		return "", errors.New("not a symlink")
+	}
+	_, target, err := pbField(data, 2)
+	return string(target), err
+}
+
+// pbField returns the value of the last occurrence of a field of a protobuf
+// message: v for a varint field or data for a length-delimited one.
+func pbField(b []byte, field int) (v uint64, data []byte, err error) {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, nil, errBadBlock
+		}
+		b = b[n:]
+		x, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, nil, errBadBlock
+		}
+		b = b[n:]
+		switch tag & 7 {
+		case 0:
+			if int(tag>>3) == field {
+				v = x
+			}
+		case 2:
+			if uint64(len(b)) < x {
+				return 0, nil, errBadBlock
+			}
+			if int(tag>>3) == field {
+				data = b[:x]
+			}
+			b = b[x:]
+		default:
+			return 0, nil, errBadBlock
+		}
+	}
+	return v, data, nil
+}
+
+var errBadBlock = errors.New("invalid dag-pb or unixfs block")
+
+func pbVarint(b []byte, field int, v uint64) []byte {
+	b = appendUvarint(b, uint64(field)<<3)
+	return appendUvarint(b, v)
+}
+
+func pbBytes(b []byte, field int, v []byte) []byte {
+	b = appendUvarint(b, uint64(field)<<3|2)
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// cidString formats a binary CID the way the daemon does: base58 for
+// version 0 and base32 for version 1.
+func cidString(cid []byte) string {
+	if cid[0] == 0x12 {
+		return base58(cid)
+	}
+	return "b" + base32Lower.EncodeToString(cid)
+}
+
+var base32Lower = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58(b []byte) string {
+	var out []byte
+	x := new(big.Int).SetBytes(b)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	for x.Sign() > 0 {
+		x.DivMod(x, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildFile(t *testing.T) {
+	for _, test := range []struct {
+		data string
+		opts DAGOptions
+		cid  string
+	}{
+		{"", DAGOptions{Chunker: "size-262144", Hash: "sha2-256", RawLeaves: true}, "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"},
+		{"", DAGOptions{Chunker: "buzhash", Hash: "sha2-256", RawLeaves: true}, "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"},
+		{"hello world", DAGOptions{Chunker: "rabin", Hash: "sha2-256"}, "Qmf412jQZiuVUtdgnB36FXFX7xg5V6KEbSJ4dpQuhkLyfD"},
+		{"hello world", DAGOptions{Chunker: "size-262144", Hash: "sha2-256"}, "Qmf412jQZiuVUtdgnB36FXFX7xg5V6KEbSJ4dpQuhkLyfD"},
+		{"hello world\n", DAGOptions{Chunker: "size-262144", Hash: "sha2-256"}, "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o"},
+	} {
+		cid, err := buildFile(strings.NewReader(test.data), test.opts, func(uint64, []byte) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cid != test.cid {
+			t.Errorf("%q with %+v: got %s, expected %s", test.data, test.opts, cid, test.cid)
+		}
+	}
+}
+
+func TestImportFile(t *testing.T) {
+	d, b := newTestBackend(t)
+	defer d.Close()
+	ctx := context.Background()
+
+	// Enough chunks for two levels of intermediate nodes.
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	for _, opts := range []DAGOptions{
+		{Chunker: "size-64", Hash: "sha2-256", RawLeaves: true},
+		{Chunker: "size-64", Hash: "sha2-256", CIDVersion: 1},
+		{Chunker: "rabin-16-32-64", Hash: "sha2-256", RawLeaves: true},
+		{Chunker: "buzhash", Hash: "sha2-256", RawLeaves: true},
+	} {
+		root, err := importFile(ctx, b, bytes.NewReader(data), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Copy(ctx, "/ipfs/"+root, "/imported"); err != nil {
+			t.Fatal(err)
+		}
+		if got := readMFS(t, b, "/imported"); got != string(data) {
+			t.Errorf("%+v: read back %d bytes, expected %d", opts, len(got), len(data))
+		}
+		if err := b.Remove(ctx, "/imported", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSymlinkNode(t *testing.T) {
+	for _, target := range []string{"", "file", "../a/b/c"} {
+		if got, err := symlinkTarget(symlinkNode(target)); err != nil || got != target {
+			t.Errorf("%q: got %q, %v", target, got, err)
+		}
+	}
+	if _, err := symlinkTarget(pbNode(nil, unixfsData([]byte("x"), 1, nil))); err == nil {
+		t.Error("file decoded as a symlink")
+	}
+}
+
+func TestWriteFileLocalDAG(t *testing.T) {
+	d, b := newTestBackend(t)
+	defer d.Close()
+	ctx := context.Background()
+
+	defer func(local bool) { *flagLocalDAG = local }(*flagLocalDAG)
+	*flagLocalDAG = true
+	opts := DAGOptions{Chunker: "size-262144", Hash: "sha2-256", RawLeaves: true}
+
+	if err := writeFile(ctx, b, "/file", strings.NewReader("old"), true, opts); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1500000000, 0)
+	if err := b.Chmod(ctx, "/file", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Touch(ctx, "/file", mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacing the file keeps its metadata and leaves nothing behind.
+	if err := writeFile(ctx, b, "/file", strings.NewReader("new"), false, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMFS(t, b, "/file"); got != "new" {
+		t.Errorf("read back %q", got)
+	}
+	stat, err := b.Stat(ctx, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode.Perm() != 0600 || stat.Mtime != mtime.Unix() {
+		t.Errorf("mode %v, mtime %d after replacing", stat.Mode, stat.Mtime)
+	}
+	for _, dir := range []string{"/", instanceDir} {
+		entries, err := b.List(ctx, dir+"/", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries.Entries {
+			if entry.Name != "file" && dir+entry.Name != unlinkedDir {
+				t.Errorf("%s left in %s after replacing", entry.Name, dir)
+			}
+		}
+	}
+
+	// Empty files are replaced directly, and keep their metadata too.
+	if err := b.Write(ctx, "/empty", strings.NewReader(""), WriteOptions{Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Chmod(ctx, "/empty", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(ctx, b, "/empty", strings.NewReader("new"), false, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMFS(t, b, "/empty"); got != "new" {
+		t.Errorf("read back %q", got)
+	}
+	if stat, err := b.Stat(ctx, "/empty"); err != nil || stat.Mode.Perm() != 0600 {
+		t.Errorf("after replacing an empty file: %+v, %v", stat, err)
+	}
+
+	if err := writeFile(ctx, b, "/missing", strings.NewReader("new"), false, opts); !isNotExist(err) {
+		t.Errorf("replacing a missing file: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// unlinkedDir is where MFS files that are removed or replaced while they are
+// open are kept until their last handle is released, so that the handles
+// keep working. It is hidden from the root directory.
+//
+// Several instances can mount the same MFS, so each one keeps its files in
+// a directory of its own in unlinkedDir, named after the host, process ID
+// and start time. At startup, only the directories of processes on this
+// host that are no longer running are removed.
+const unlinkedDir = "/.ipfs-fuse-unlinked"
+
+var hostname, _ = os.Hostname()
+
+// instanceDir is the directory in unlinkedDir for this process.
+var instanceDir = path.Join(unlinkedDir, hostname+"-"+strconv.Itoa(os.Getpid())+"-"+strconv.FormatInt(time.Now().UnixNano(), 36))
+
+// hide moves the MFS file at p into instanceDir and returns its new path.
+func (n *UnixFSNode) hide(ctx context.Context, p string) (string, error) {
+	hidden, err := hiddenPath(ctx, n.Backend, p)
+	if err != nil {
+		return "", err
+	}
+	if err := n.Backend.Move(ctx, p, hidden); err != nil {
+		return "", err
+	}
+	return hidden, nil
+}
+
+// hiddenPath creates instanceDir if needed and returns an unused path in it
+// for a file named like p.
+func hiddenPath(ctx context.Context, b Backend, p string) (string, error) {
+	for _, dir := range []string{unlinkedDir, instanceDir} {
+		stat, err := b.Stat(ctx, dir)
+		if err != nil {
+			return "", err
+		}
+		if stat == nil {
+			if err := b.Mkdir(ctx, dir, defaultDAGOptions()); err != nil && !isExist(err) {
+				return "", err
+			}
+		}
+	}
+
+	return path.Join(instanceDir, strconv.FormatInt(time.Now().UnixNano(), 36)+"-"+path.Base(p)), nil
+}
+
+// keepUnlinked points n at the file that was hidden at hidden, if n has
+// open handles, and reports whether it did. The hidden file is removed when
+// the last handle is released.
+func (n *UnixFSNode) keepUnlinked(hidden string) bool {
+	opts := n.dagOptions()
+	dir := &UnixFSNode{
+		Backend: n.Backend,
+		parent: &UnixFSNode{
+			Backend: n.Backend,
+			parent:  n.root(),
+			name:    path.Base(unlinkedDir),
+		},
+		name: path.Base(instanceDir),
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.files) == 0 {
+		return false
+	}
+	n.unlinked = true
+	// Writes made through the remaining handles keep the settings of the
+	// directory the file was in.
+	for _, attr := range dagXAttrs {
+		setOverride(hidden, attr, opts.get(attr))
+	}
+	treeMu.Lock()
+	n.parent, n.name = dir, path.Base(hidden)
+	treeMu.Unlock()
+	return true
+}
+
+// isHidden reports whether name in n is unlinkedDir.
+func (n *UnixFSNode) isHidden(name string) bool {
+	return path.Join(n.Path(), name) == unlinkedDir
+}
+
+func (n *UnixFSNode) root() *UnixFSNode {
+	treeMu.RLock()
+	defer treeMu.RUnlock()
+
+	for n.parent != nil {
+		n = n.parent
+	}
+	return n
+}
+
+// openChild returns the node of the child of n named name if it has open
+// handles.
+func (n *UnixFSNode) openChild(name string) *UnixFSNode {
+	child := n.Inode().GetChild(name)
+	if child == nil {
+		return nil
+	}
+	node, ok := child.Node().(*UnixFSNode)
+	if !ok {
+		return nil
+	}
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if len(node.files) == 0 {
+		return nil
+	}
+	return node
+}
+
+// removeUnlinked removes the hidden file of n once it is no longer open.
+func (n *UnixFSNode) removeUnlinked(ctx context.Context) {
+	removeHidden(ctx, n.Backend, n.Path())
+	moveOverrides(n.Path(), "")
+	moveSeen(n.Path(), "")
+}
+
+func removeHidden(ctx context.Context, backend Backend, hidden string) {
+	if err := backend.Remove(ctx, hidden, true); err != nil && !isNotExist(err) {
+		log.Println("Cannot remove", hidden+":", err)
+	}
+}
+
+// cleanUnlinked removes the files left in unlinkedDir by earlier runs on
+// this host that have exited.
+func cleanUnlinked(ctx context.Context, backend Backend) error {
+	list, err := backend.List(ctx, unlinkedDir+"/", false)
+	if err != nil || list == nil {
+		return err
+	}
+	for _, entry := range list.Entries {
+		if isStaleInstance(entry.Name) {
+			removeHidden(ctx, backend, path.Join(unlinkedDir, entry.Name))
+		}
+	}
+	return nil
+}
+
+// isStaleInstance reports whether name in unlinkedDir belongs to a process
+// on this host that is no longer running. If its process ID has been reused
+// by another process, the directory stays until that one exits too.
+func isStaleInstance(name string) bool {
+	i := strings.LastIndexByte(name, '-')
+	if i < 0 {
+		return false
+	}
+	j := strings.LastIndexByte(name[:i], '-')
+	if j < 0 || name[:j] != hostname {
+		return false
+	}
+	pid, err := strconv.Atoi(name[j+1 : i])
+	if err != nil {
+		return false
+	}
+	if pid == os.Getpid() {
+		return path.Join(unlinkedDir, name) != instanceDir
+	}
+	return syscall.Kill(pid, 0) == syscall.ESRCH
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestCleanUnlinked(t *testing.T) {
+	d, b := newTestBackend(t)
+	defer d.Close()
+	ctx := context.Background()
+
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip("cannot run true:", err)
+	}
+	exited := strconv.Itoa(cmd.ProcessState.Pid())
+
+	dirs := map[string]bool{
+		hostname + "-" + exited + "-1":                     false,
+		hostname + "-" + strconv.Itoa(os.Getpid()) + "-1":  false,
+		hostname + "-" + strconv.Itoa(os.Getppid()) + "-1": true,
+		"elsewhere-" + exited + "-1":                       true,
+		path.Base(instanceDir):                             true,
+	}
+	if err := b.Mkdir(ctx, unlinkedDir, DAGOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for name := range dirs {
+		if err := b.Mkdir(ctx, path.Join(unlinkedDir, name), DAGOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cleanUnlinked(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	list, err := b.List(ctx, unlinkedDir+"/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left, expected []string
+	for _, entry := range list.Entries {
+		left = append(left, entry.Name)
+	}
+	for name, keep := range dirs {
+		if keep {
+			expected = append(expected, name)
+		}
+	}
+	sort.Strings(left)
+	sort.Strings(expected)
+	if len(left) != len(expected) {
+		t.Fatalf("left %v, expected %v", left, expected)
+	}
+	for i := range left {
+		if left[i] != expected[i] {
+			t.Fatalf("left %v, expected %v", left, expected)
+		}
+	}
+}
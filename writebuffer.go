@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+)
+
+var flagWriteBuffer = flag.Int("write-buffer", 4<<20, "number of bytes of adjacent writes to an MFS file to combine into one request (0 to disable)")
+var flagWriteDelay = flag.Duration("write-delay", time.Second, "maximum time to hold buffered writes to an MFS file before sending them")
+
+// openFile returns a new handle for n. Handles are tracked so that their
+// buffered writes can be sent before anything else looks at the file.
+func (n *UnixFSNode) openFile(flags uint32, ctx *fuse.Context) (*UnixFSFile, fuse.Status) {
+	f := &UnixFSFile{File: nodefs.NewDefaultFile(), Node: n}
+
+	if *flagSpoolDir != "" && flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		c, cancel := opContext(ctx, *flagIOTimeout)
+		defer cancel()
+
+		s, err := n.openSpool(c, flags&syscall.O_TRUNC != 0)
+		if err != nil {
+			return nil, errorStatus(c, err, "Open", n.Path())
+		}
+		f.spool = s
+	}
+
+	n.mu.Lock()
+	if n.files == nil {
+		n.files = make(map[*UnixFSFile]bool)
+	}
+	n.files[f] = true
+	n.mu.Unlock()
+
+	return f, fuse.OK
+}
+
+func (n *UnixFSNode) releaseFile(ctx context.Context, f *UnixFSFile) {
+	n.mu.Lock()
+	delete(n.files, f)
+	remove := n.unlinked && len(n.files) == 0
+	n.mu.Unlock()
+
+	if remove {
+		n.removeUnlinked(ctx)
+	}
+}
+
+// flushWrites sends the buffered writes of every open handle of n. Errors are
+// kept to be reported by the handle that made the writes.
+func (n *UnixFSNode) flushWrites(ctx context.Context) {
+	n.mu.Lock()
+	files := make([]*UnixFSFile, 0, len(n.files))
+	for f := range n.files {
+		files = append(files, f)
+	}
+	n.mu.Unlock()
+
+	for _, f := range files {
+		f.wmu.Lock()
+		if err := f.flushLocked(ctx); err != nil && f.werr == nil {
+			f.werr = err
+		}
+		f.wmu.Unlock()
+	}
+}
+
+// flushChild sends the buffered writes of the child of n named name, if it
+// has been looked up.
+func (n *UnixFSNode) flushChild(name string, ctx *fuse.Context) {
+	child := n.Inode().GetChild(name)
+	if child == nil {
+		return
+	}
+	if node, ok := child.Node().(*UnixFSNode); ok {
+		c, cancel := opContext(ctx, *flagIOTimeout)
+		node.flushWrites(c)
+		if err := node.commitSpool(c); err != nil {
+			errorStatus(c, err, "Write", node.Path())
+		}
+		cancel()
+	}
+}
+
+// bufferWrite adds a write to the buffer, sending the buffer first if the
+// write is not adjacent to it, and afterwards if it is full.
+func (f *UnixFSFile) bufferWrite(ctx context.Context, data []byte, off int64) error {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	if err := f.werr; err != nil {
+		f.werr = nil
+		return err
+	}
+
+	if len(f.wbuf) != 0 && off != f.woff+int64(len(f.wbuf)) {
+		if err := f.flushLocked(ctx); err != nil {
+			return err
+		}
+	}
+	if len(f.wbuf) == 0 {
+		f.woff = off
+	}
+	f.wbuf = append(f.wbuf, data...)
+
+	if len(f.wbuf) >= *flagWriteBuffer {
+		return f.flushLocked(ctx)
+	}
+	if f.wtimer == nil {
+		f.wtimer = time.AfterFunc(*flagWriteDelay, f.flushLater)
+	}
+	return nil
+}
+
+// flushLater is called when writes have been buffered for too long.
+func (f *UnixFSFile) flushLater() {
+	c, cancel := opContext(nil, *flagIOTimeout)
+	defer cancel()
+
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	if err := f.flushLocked(c); err != nil && f.werr == nil {
+		f.werr = err
+	}
+}
+
+// flushLocked sends the buffered writes. f.wmu must be held. The buffer is
+// emptied even if the request fails, as there is no way to tell how much of
+// it the daemon applied.
+func (f *UnixFSFile) flushLocked(ctx context.Context) error {
+	if f.wtimer != nil {
+		f.wtimer.Stop()
+		f.wtimer = nil
+	}
+	if len(f.wbuf) == 0 {
+		return nil
+	}
+
+	err := f.Node.Backend.Write(ctx, f.Node.Path(), bytes.NewReader(f.wbuf), WriteOptions{Offset: f.woff, DAG: f.Node.dagOptions()})
+	f.wbuf = f.wbuf[:0]
+	return err
+}
+
+// flushBuffer sends the buffered writes and returns the first error from
+// any write since the last call, so that it can be reported by close or
+// fsync.
+func (f *UnixFSFile) flushBuffer(ctx context.Context) error {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	err := f.flushLocked(ctx)
+	if f.werr != nil {
+		err = f.werr
+		f.werr = nil
+	}
+	return err
+}